@@ -0,0 +1,452 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nullable returns the productions that can match without consuming any
+// input. Lexer functions are assumed to always consume input.
+func (p *pbpgData) nullable() map[string]bool {
+	n := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, k := range p.orderedStates {
+			if !n[k] && p.stateMap[k].nullable(n) {
+				n[k] = true
+				changed = true
+			}
+		}
+	}
+	return n
+}
+
+// nullable returns true if the expression can match without consuming any
+// input, given the nullable productions in n.
+func (e *Expression) nullable(n map[string]bool) bool {
+	for _, a := range e.alternatives {
+		if a.nullable(n) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Alternative) nullable(n map[string]bool) bool {
+	for _, t := range a.terms {
+		if !t.nullable(n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Term) nullable(n map[string]bool) bool {
+	switch t.option {
+	case TERM_NAME:
+		return n[t.state()]
+	case TERM_LITERAL:
+		return t.literal == ""
+	case TERM_GOR:
+		return t.gor.option != GOR_GROUP || t.gor.expression.nullable(n)
+	case TERM_ACTION:
+		return true
+	}
+	return false
+}
+
+// leftNames returns the productions the expression can call before consuming
+// any input, given the nullable productions in n.
+func (e *Expression) leftNames(n map[string]bool) []string {
+	var r []string
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if t.option == TERM_NAME {
+				r = append(r, t.state())
+			} else if t.option == TERM_GOR {
+				r = append(r, t.gor.expression.leftNames(n)...)
+			}
+			if !t.nullable(n) {
+				break
+			}
+		}
+	}
+	return r
+}
+
+// leftGraph returns, for each production, the productions it can call before
+// consuming any input.
+func (p *pbpgData) leftGraph() map[string][]string {
+	n := p.nullable()
+	g := make(map[string][]string)
+	for _, k := range p.orderedStates {
+		g[k] = p.stateMap[k].leftNames(n)
+	}
+	return g
+}
+
+// leftCycle returns the chain of productions from start back to itself, if
+// start can call itself before consuming any input. Productions in skip are
+// not followed.
+func leftCycle(g map[string][]string, start string, skip map[string]bool) []string {
+	seen := make(map[string]bool)
+	var visit func(k string, chain []string) []string
+	visit = func(k string, chain []string) []string {
+		for _, v := range g[k] {
+			if v == start {
+				return append(chain, v)
+			}
+			if seen[v] || skip[v] {
+				continue
+			}
+			seen[v] = true
+			if r := visit(v, append(chain, v)); r != nil {
+				return r
+			}
+		}
+		return nil
+	}
+	return visit(start, []string{start})
+}
+
+// findLeaders returns the productions whose results are grown from a seed so
+// that left recursion terminates. Productions are considered in source order,
+// and each one that can still call itself through productions that are not
+// leaders becomes one, so every left recursive cycle has at least one leader.
+func (p *pbpgData) findLeaders() (map[string]bool, error) {
+	g := p.leftGraph()
+
+	// the result of a production with parameters depends on its arguments,
+	// so it can't be grown from a seed at a position.
+	for _, k := range p.orderedStates {
+		if _, ok := p.inherited[k]; !ok {
+			continue
+		}
+		if chain := leftCycle(g, k, nil); chain != nil {
+			return nil, fmt.Errorf("%v: left recursion through a production with parameters is not supported: %v", k, strings.Join(chain, " > "))
+		}
+	}
+
+	leaders := make(map[string]bool)
+	for _, k := range p.orderedStates {
+		if leftCycle(g, k, leaders) != nil {
+			leaders[k] = true
+		}
+	}
+	return leaders, nil
+}
+
+// leftReach returns the productions k can call before consuming any input,
+// directly or through other productions.
+func leftReach(g map[string][]string, k string) map[string]bool {
+	r := make(map[string]bool)
+	queue := append([]string{}, g[k]...)
+	for len(queue) > 0 {
+		v := queue[0]
+		queue = queue[1:]
+		if !r[v] {
+			r[v] = true
+			queue = append(queue, g[v]...)
+		}
+	}
+	return r
+}
+
+// cycleMembers returns the productions other than leaders that are in a left
+// recursive cycle with a leader.
+func (p *pbpgData) cycleMembers() map[string]bool {
+	g := p.leftGraph()
+	r := make(map[string]bool)
+	for _, l := range p.orderedStates {
+		if !p.leaders[l] {
+			continue
+		}
+		reach := leftReach(g, l)
+		for _, k := range p.orderedStates {
+			if k != l && !p.leaders[k] && reach[k] && leftReach(g, k)[l] {
+				r[k] = true
+			}
+		}
+	}
+	return r
+}
+
+// seedsFirst returns a warning for each alternative in a left recursive cycle
+// that leads back to the cycle's leader, but follows an alternative that
+// doesn't. Alternatives are tried in order, so each round of growing the
+// leader's result matches the earlier alternative again wherever it can, and
+// the result never grows past it, as in F = lex(Num) | F "!" .
+func (p *pbpgData) seedsFirst() []string {
+	n := p.nullable()
+	g := p.leftGraph()
+	reach := make(map[string]map[string]bool)
+	for _, k := range p.orderedStates {
+		reach[k] = leftReach(g, k)
+	}
+
+	var r []string
+	for _, k := range p.orderedStates {
+		// the first leader k is in a cycle with
+		var leader string
+		for _, l := range p.orderedStates {
+			if p.leaders[l] && (l == k || reach[l][k]) && reach[k][l] {
+				leader = l
+				break
+			}
+		}
+		if leader == "" {
+			continue
+		}
+
+		var seed *Alternative
+		for _, a := range p.stateMap[k].alternatives {
+			recursive := false
+			for _, v := range a.expression().leftNames(n) {
+				if v == leader || reach[v][leader] {
+					recursive = true
+				}
+			}
+			if !recursive {
+				if seed == nil {
+					seed = a
+				}
+			} else if seed != nil {
+				r = append(r, fmt.Sprintf("%v: left recursive alternative %v follows %v, so %v can't grow past what %v matches", k, a, seed, leader, seed))
+			}
+		}
+	}
+	return r
+}
+
+// productive returns the productions that can match some input. The others
+// can only fail, such as A = "(" A ")", which needs infinite input.
+func (p *pbpgData) productive() map[string]bool {
+	m := make(map[string]bool)
+	for changed := true; changed; {
+		changed = false
+		for _, k := range p.orderedStates {
+			if !m[k] && p.stateMap[k].productive(m) {
+				m[k] = true
+				changed = true
+			}
+		}
+	}
+	return m
+}
+
+func (e *Expression) productive(m map[string]bool) bool {
+	for _, a := range e.alternatives {
+		if a.productive(m) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *Alternative) productive(m map[string]bool) bool {
+	for _, t := range a.terms {
+		if !t.productive(m) {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Term) productive(m map[string]bool) bool {
+	switch t.option {
+	case TERM_NAME:
+		return m[t.state()]
+	case TERM_GOR:
+		return t.gor.option != GOR_GROUP || t.gor.expression.productive(m)
+	}
+	return true
+}
+
+// unproductiveNames returns the productions keeping an expression that can't
+// match any input from matching: for each alternative, the production named
+// by its first term that can't match.
+func (e *Expression) unproductiveNames(m map[string]bool) []string {
+	var r []string
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if t.productive(m) {
+				continue
+			}
+			if t.option == TERM_NAME {
+				r = append(r, t.state())
+			} else {
+				r = append(r, t.gor.expression.unproductiveNames(m)...)
+			}
+			break
+		}
+	}
+	return r
+}
+
+// nullChain returns the productions through which an expression that can
+// match without consuming any input does so, outermost first.
+func (p *pbpgData) nullChain(e *Expression, n map[string]bool, seen map[string]bool) []string {
+	for _, a := range e.alternatives {
+		if !a.nullable(n) {
+			continue
+		}
+		for _, t := range a.terms {
+			if t.option == TERM_NAME && !seen[t.state()] {
+				seen[t.state()] = true
+				return append([]string{t.state()}, p.nullChain(p.stateMap[t.state()], n, seen)...)
+			}
+			if t.option == TERM_GOR && t.gor.option == GOR_GROUP {
+				if r := p.nullChain(t.gor.expression, n, seen); r != nil {
+					return r
+				}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// checkLoops returns an error if the body of a repetition can match without
+// consuming any input, which would repeat forever if the parser didn't stop
+// the repetition, or if a production can never match because every way of
+// matching it recurses without end. Both errors name the chain of productions
+// responsible.
+func (p *pbpgData) checkLoops() error {
+	n := p.nullable()
+	for _, k := range p.orderedStates {
+		err := p.stateMap[k].walk(func(t *Term) error {
+			if t.option != TERM_GOR || t.gor.option != GOR_REPETITION || !t.gor.expression.nullable(n) {
+				return nil
+			}
+			err := fmt.Errorf("%v: repetition %v can match without consuming any input", k, t)
+			if chain := p.nullChain(t.gor.expression, n, make(map[string]bool)); chain != nil {
+				err = fmt.Errorf("%w, through %v", err, strings.Join(chain, " > "))
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	m := p.productive()
+	for _, k := range p.orderedStates {
+		if m[k] {
+			continue
+		}
+		// every production that can't match uses another that can't, so
+		// following them always leads to a cycle. The chain names the
+		// cycle through k if there is one, and otherwise the way from k to
+		// a cycle.
+		g := make(map[string][]string)
+		for _, v := range p.orderedStates {
+			if !m[v] {
+				g[v] = p.stateMap[v].unproductiveNames(m)
+			}
+		}
+		chain := []string{k}
+		for v := k; ; v = g[v][0] {
+			if cycle := leftCycle(g, v, nil); cycle != nil {
+				chain = append(chain, cycle[1:]...)
+				break
+			}
+			chain = append(chain, g[v][0])
+		}
+		return fmt.Errorf("state %v can never match, as it recurses without end: %v", k, strings.Join(chain, " > "))
+	}
+	return nil
+}
+
+// shadowed returns a warning for each alternative that can never match,
+// because an earlier alternative of the same expression matches whenever it
+// would. This is the case when the earlier alternative can't fail, or when
+// its terms are the same as the leading terms of the later one, with the last
+// of them allowed to be a literal that is a prefix of the other's, as in
+// "Cat" | "Caterpillar".
+func (p *pbpgData) shadowed() []string {
+	var r []string
+	check := func(name string, e *Expression) {
+		for i, a := range e.alternatives {
+			for _, b := range e.alternatives[:i] {
+				if b.shadows(a) {
+					r = append(r, fmt.Sprintf("%v: alternative %v can never match, as the earlier alternative %v always matches first", name, a, b))
+					break
+				}
+			}
+		}
+	}
+	for _, v := range p.lines {
+		prod := v.production
+		if prod == nil {
+			continue
+		}
+		name := prod.name
+		if prod.params != nil {
+			name += "(" + strings.Join(prod.params, ", ") + ")"
+		}
+		check(name, prod.exp)
+		prod.exp.walk(func(t *Term) error {
+			if t.option == TERM_GOR {
+				check(name, t.gor.expression)
+			}
+			return nil
+		})
+	}
+	return r
+}
+
+// shadows returns true if the alternative matches whenever b would, so that b
+// can never match when it follows it.
+func (a *Alternative) shadows(b *Alternative) bool {
+	if a.action != nil && a.action.fallible {
+		return false
+	}
+
+	infallible := true
+	for _, t := range a.terms {
+		switch {
+		case t.option == TERM_GOR && t.gor.option != GOR_GROUP:
+		case t.option == TERM_ACTION && !t.action.fallible:
+		default:
+			infallible = false
+		}
+	}
+	if infallible {
+		return true
+	}
+
+	if len(a.terms) > len(b.terms) {
+		return false
+	}
+	last := len(a.terms) - 1
+	for i, t := range a.terms[:last] {
+		if !t.sameAs(b.terms[i]) {
+			return false
+		}
+	}
+	x, y := a.terms[last], b.terms[last]
+	if x.sameAs(y) {
+		return true
+	}
+	// tokens are matched whole, so a literal is only a prefix of another in
+	// string mode.
+	return !*fToken && x.option == TERM_LITERAL && y.option == TERM_LITERAL && strings.HasPrefix(y.literal, x.literal)
+}
+
+// sameAs returns true if both terms match the same input. Actions are never
+// the same, as they may have side effects.
+func (t *Term) sameAs(u *Term) bool {
+	if t.option == TERM_ACTION || u.option == TERM_ACTION {
+		return false
+	}
+	x, y := *t, *u
+	x.binding, x.label, y.binding, y.label = "", "", "", ""
+	return x.String() == y.String()
+}
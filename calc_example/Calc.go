@@ -18,167 +18,125 @@ type CalcData struct{}
 func main() {
 	result, err := ParseCalc(os.Args[1], nil)
 	if err != nil {
+		var perr *CalcParseError
+		if errors.As(err, &perr) {
+			log.Fatal(perr.Pretty(os.Args[1]))
+		}
 		log.Fatal(err)
 	}
 	fmt.Println(result)
 }
 
-// Expression = Term { AddOp Term }
+// Expression = Factor
 func (p *CalcParser) stateExpression() (int, error) {
 	var err error
+	entryPos := p.pos
 	var ret int
-	var v1 int
-	var v2temp string
-	var v2 []string
-	var v3temp int
-	var v3 []int
-	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateTerm()
-	if p.errorStack.coalesce() != nil {
-		v1ErrorStack.merge(p.errorStack)
-	}
-	p.errorStack = v1ErrorStack
-	if err == nil {
-		// repetition
-		for {
-			p = p.predict()
-			v2ErrorStack := p.errorStack
-			p.errorStack = &parserErrorStack{}
-			v2temp, err = p.stateAddOp()
-			if p.errorStack.coalesce() != nil {
-				v2ErrorStack.merge(p.errorStack)
-			}
-			p.errorStack = v2ErrorStack
-			if err == nil {
-				v3ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
-				v3temp, err = p.stateTerm()
-				if p.errorStack.coalesce() != nil {
-					v3ErrorStack.merge(p.errorStack)
-				}
-				p.errorStack = v3ErrorStack
-			}
-			if err != nil {
-				p = p.backtrack()
-				err = nil
-				break
-			} else {
-				v2 = append(v2, v2temp)
-				v3 = append(v3, v3temp)
-				p = p.accept()
-			}
-		}
-	}
-	if err == nil {
-		ret = p.Data.actionExpression(p.pos, v1, v2, v3)
+	p.productions = append(p.productions, "Expression")
+	ret, err = p.climbExpression(1)
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *CalcData) actionExpression(pos int, v1 int, v2 []string, v3 []int) int {
-	r := v1
-	for i, v := range v2 {
-		switch v {
-		case "+":
-			r = r + v3[i]
-		case "-":
-			r = r - v3[i]
-		}
-	}
-
-	return r
-
-}
-
-// Term = Factor { MultOp Factor }
-func (p *CalcParser) stateTerm() (int, error) {
-	var err error
-	var ret int
-	var v1 int
-	var v2temp string
-	var v2 []string
-	var v3temp int
-	var v3 []int
-	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateFactor()
+func (p *CalcParser) climbExpression(min int) (int, error) {
+	entryPos := p.pos
+	operandErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	lhs, err := p.stateFactor()
 	if p.errorStack.coalesce() != nil {
-		v1ErrorStack.merge(p.errorStack)
+		operandErrorStack.merge(p.errorStack)
 	}
-	p.errorStack = v1ErrorStack
-	if err == nil {
-		// repetition
-		for {
-			p = p.predict()
-			v2ErrorStack := p.errorStack
-			p.errorStack = &parserErrorStack{}
-			v2temp, err = p.stateMultOp()
-			if p.errorStack.coalesce() != nil {
-				v2ErrorStack.merge(p.errorStack)
+	p.errorStack = operandErrorStack
+	if err != nil {
+		return lhs, err
+	}
+
+	for {
+		p = p.predict()
+		var op string
+		var level, next int
+		if _, err = p.literal("+"); err == nil {
+			op, level, next = "+", 1, 2
+		} else {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"+\"")
+		}
+		if op == "" {
+			if _, err = p.literal("-"); err == nil {
+				op, level, next = "-", 1, 2
+			} else {
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"-\"")
 			}
-			p.errorStack = v2ErrorStack
-			if err == nil {
-				v3ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
-				v3temp, err = p.stateFactor()
-				if p.errorStack.coalesce() != nil {
-					v3ErrorStack.merge(p.errorStack)
-				}
-				p.errorStack = v3ErrorStack
+		}
+		if op == "" {
+			if _, err = p.literal("*"); err == nil {
+				op, level, next = "*", 2, 3
+			} else {
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"*\"")
 			}
-			if err != nil {
-				p = p.backtrack()
-				err = nil
-				break
+		}
+		if op == "" {
+			if _, err = p.literal("/"); err == nil {
+				op, level, next = "/", 2, 3
 			} else {
-				v2 = append(v2, v2temp)
-				v3 = append(v3, v3temp)
-				p = p.accept()
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"/\"")
 			}
 		}
+		if op == "" || level < min {
+			p = p.backtrack()
+			break
+		}
+		var rhs int
+		rhs, err = p.climbExpression(next)
+		if err != nil {
+			p = p.backtrack()
+			break
+		}
+		ctx := p.context(entryPos, "Expression")
+		lhs = p.Data.actionExpression(p.pos, ctx, lhs, op, rhs)
+		p = p.accept()
 	}
-	if err == nil {
-		ret = p.Data.actionTerm(p.pos, v1, v2, v3)
-	}
-
-	return ret, err
+	return lhs, nil
 }
 
-func (p *CalcData) actionTerm(pos int, v1 int, v2 []string, v3 []int) int {
-	r := v1
-	for i, v := range v2 {
-		switch v {
-		case "*":
-			r = r * v3[i]
-		case "/":
-			r = r / v3[i]
-		}
+func (p *CalcData) actionExpression(pos int, ctx CalcContext, lhs int, op string, rhs int) int {
+	switch op {
+	case "+":
+		return lhs + rhs
+	case "-":
+		return lhs - rhs
+	case "*":
+		return lhs * rhs
+	default:
+		return lhs / rhs
 	}
-	return r
 
 }
 
-// Factor = ( "(" Expression ")" ) | Number
+// Factor = "(" Expression ")" | Number
 func (p *CalcParser) stateFactor() (int, error) {
 	var err error
+	entryPos := p.pos
 	var ret int
 	var a1Pos int
 	var v1 string
 	var v2 int
 	var v3 string
 	var v4 int
+	_ = a1Pos
+	p.productions = append(p.productions, "Factor")
 	a1Pos = 1
-	// group
 	p = p.predict()
 	v1, err = p.literal("(")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"(\"")
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateExpression()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
@@ -187,10 +145,14 @@ func (p *CalcParser) stateFactor() (int, error) {
 		if err == nil {
 			v3, err = p.literal(")")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\")\"")
 			}
 		}
 	}
+	if err == nil {
+		ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+		ret = p.Data.actionFactor_1(p.pos, ctx, v1, v2, v3)
+	}
 	if err != nil {
 		p = p.backtrack()
 	} else {
@@ -199,129 +161,51 @@ func (p *CalcParser) stateFactor() (int, error) {
 	if err != nil {
 		a1Pos = 2
 		v4ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v4, err = p.stateNumber()
 		if p.errorStack.coalesce() != nil {
 			v4ErrorStack.merge(p.errorStack)
 		}
 		p.errorStack = v4ErrorStack
-		if err != nil {
-			a1Pos = -1
-		}
-	}
-	if err == nil {
-		ret = p.Data.actionFactor(p.pos, a1Pos, v1, v2, v3, v4)
-	}
-
-	return ret, err
-}
-
-func (p *CalcData) actionFactor(pos int, a1Pos int, v1 string, v2 int, v3 string, v4 int) int {
-	var r int
-	switch a1Pos {
-	case 1:
-		r = v2
-	case 2:
-		r = v4
-	}
-	return r
-
-}
-
-// AddOp = "+" | "-"
-func (p *CalcParser) stateAddOp() (string, error) {
-	var err error
-	var ret string
-	var a1Pos int
-	var v1 string
-	var v2 string
-	a1Pos = 1
-	v1, err = p.literal("+")
-	if err != nil {
-		p.errorStack.error(err, p.pos)
-	}
-	if err != nil {
-		a1Pos = 2
-		v2, err = p.literal("-")
-		if err != nil {
-			p.errorStack.error(err, p.pos)
+		if err == nil {
+			ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+			ret = p.Data.actionFactor_2(p.pos, ctx, v4)
 		}
 		if err != nil {
 			a1Pos = -1
 		}
 	}
-	if err == nil {
-		ret = p.Data.actionAddOp(p.pos, a1Pos, v1, v2)
-	}
-
-	return ret, err
-}
-
-func (p *CalcData) actionAddOp(pos int, a1Pos int, v1 string, v2 string) string {
-	var r string
-	switch a1Pos {
-	case 1:
-		r = v1
-	case 2:
-		r = v2
-	}
-	return r
-
-}
-
-// MultOp = "*" | "/"
-func (p *CalcParser) stateMultOp() (string, error) {
-	var err error
-	var ret string
-	var a1Pos int
-	var v1 string
-	var v2 string
-	a1Pos = 1
-	v1, err = p.literal("*")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
-	}
-	if err != nil {
-		a1Pos = 2
-		v2, err = p.literal("/")
-		if err != nil {
-			p.errorStack.error(err, p.pos)
-		}
-		if err != nil {
-			a1Pos = -1
-		}
-	}
-	if err == nil {
-		ret = p.Data.actionMultOp(p.pos, a1Pos, v1, v2)
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *CalcData) actionMultOp(pos int, a1Pos int, v1 string, v2 string) string {
-	var r string
-	switch a1Pos {
-	case 1:
-		r = v1
-	case 2:
-		r = v2
-	}
-	return r
+func (p *CalcData) actionFactor_1(pos int, ctx CalcContext, v1 string, v2 int, v3 string) int {
+	return v2
+}
 
+func (p *CalcData) actionFactor_2(pos int, ctx CalcContext, v1 int) int {
+	return v1
 }
 
 // Number = [ Neg ] Digit { Digit }
 func (p *CalcParser) stateNumber() (int, error) {
 	var err error
+	entryPos := p.pos
+	entryMark := len(p.errorStack.stack)
 	var ret int
 	var v1 string
 	var v2 string
 	var v3temp string
 	var v3 []string
+	p.productions = append(p.productions, "Number")
 	// option
 	p = p.predict()
 	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
+	p.errorStack = p.errorStack.fresh()
 	v1, err = p.stateNeg()
 	if p.errorStack.coalesce() != nil {
 		v1ErrorStack.merge(p.errorStack)
@@ -335,7 +219,7 @@ func (p *CalcParser) stateNumber() (int, error) {
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateDigit()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
@@ -345,14 +229,15 @@ func (p *CalcParser) stateNumber() (int, error) {
 			// repetition
 			for {
 				p = p.predict()
+				repPos := p.pos
 				v3ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
+				p.errorStack = p.errorStack.fresh()
 				v3temp, err = p.stateDigit()
 				if p.errorStack.coalesce() != nil {
 					v3ErrorStack.merge(p.errorStack)
 				}
 				p.errorStack = v3ErrorStack
-				if err != nil {
+				if err != nil || p.pos == repPos {
 					p = p.backtrack()
 					err = nil
 					break
@@ -364,42 +249,55 @@ func (p *CalcParser) stateNumber() (int, error) {
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionNumber(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Number")
+		ret, err = p.Data.actionNumber(p.pos, ctx, v1, v2, v3)
+		if err != nil {
+			p.errorStack.reject(err, entryMark, p.pos, p.productions)
+		}
 	}
 
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *CalcData) actionNumber(pos int, v1 string, v2 string, v3 []string) int {
+func (p *CalcData) actionNumber(pos int, ctx CalcContext, v1 string, v2 string, v3 []string) (int, error) {
 	stringNumber := v1 + v2 + strings.Join(v3, "")
-	num, _ := strconv.Atoi(stringNumber)
-	return num
+	return strconv.Atoi(stringNumber)
 
 }
 
 // Neg = "-"
 func (p *CalcParser) stateNeg() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
+	p.productions = append(p.productions, "Neg")
 	v1, err = p.literal("-")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"-\"")
 	}
 	if err == nil {
-		ret = p.Data.actionNeg(p.pos, v1)
+		ctx := p.context(entryPos, "Neg")
+		ret = p.Data.actionNeg(p.pos, ctx, v1)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *CalcData) actionNeg(pos int, v1 string) string {
+func (p *CalcData) actionNeg(pos int, ctx CalcContext, v1 string) string {
 	return v1
 }
 
 // Digit = "0" | "1" | "2" | "3" | "4" | "5" | "6" | "7" | "8" | "9"
 func (p *CalcParser) stateDigit() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var a1Pos int
 	var v1 string
@@ -412,64 +310,65 @@ func (p *CalcParser) stateDigit() (string, error) {
 	var v8 string
 	var v9 string
 	var v10 string
+	p.productions = append(p.productions, "Digit")
 	a1Pos = 1
 	v1, err = p.literal("0")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"0\"")
 	}
 	if err != nil {
 		a1Pos = 2
 		v2, err = p.literal("1")
 		if err != nil {
-			p.errorStack.error(err, p.pos)
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"1\"")
 		}
 		if err != nil {
 			a1Pos = 3
 			v3, err = p.literal("2")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"2\"")
 			}
 			if err != nil {
 				a1Pos = 4
 				v4, err = p.literal("3")
 				if err != nil {
-					p.errorStack.error(err, p.pos)
+					p.errorStack.expect(err, p.errorPos(err), p.productions, "\"3\"")
 				}
 				if err != nil {
 					a1Pos = 5
 					v5, err = p.literal("4")
 					if err != nil {
-						p.errorStack.error(err, p.pos)
+						p.errorStack.expect(err, p.errorPos(err), p.productions, "\"4\"")
 					}
 					if err != nil {
 						a1Pos = 6
 						v6, err = p.literal("5")
 						if err != nil {
-							p.errorStack.error(err, p.pos)
+							p.errorStack.expect(err, p.errorPos(err), p.productions, "\"5\"")
 						}
 						if err != nil {
 							a1Pos = 7
 							v7, err = p.literal("6")
 							if err != nil {
-								p.errorStack.error(err, p.pos)
+								p.errorStack.expect(err, p.errorPos(err), p.productions, "\"6\"")
 							}
 							if err != nil {
 								a1Pos = 8
 								v8, err = p.literal("7")
 								if err != nil {
-									p.errorStack.error(err, p.pos)
+									p.errorStack.expect(err, p.errorPos(err), p.productions, "\"7\"")
 								}
 								if err != nil {
 									a1Pos = 9
 									v9, err = p.literal("8")
 									if err != nil {
-										p.errorStack.error(err, p.pos)
+										p.errorStack.expect(err, p.errorPos(err), p.productions, "\"8\"")
 									}
 									if err != nil {
 										a1Pos = 10
 										v10, err = p.literal("9")
 										if err != nil {
-											p.errorStack.error(err, p.pos)
+											p.errorStack.expect(err, p.errorPos(err), p.productions, "\"9\"")
 										}
 										if err != nil {
 											a1Pos = -1
@@ -484,28 +383,31 @@ func (p *CalcParser) stateDigit() (string, error) {
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionDigit(p.pos, a1Pos, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10)
+		ctx := p.context(entryPos, "Digit")
+		ret = p.Data.actionDigit(p.pos, ctx, a1Pos, v1, v2, v3, v4, v5, v6, v7, v8, v9, v10)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *CalcData) actionDigit(pos int, a1Pos int, v1 string, v2 string, v3 string, v4 string, v5 string, v6 string, v7 string, v8 string, v9 string, v10 string) string {
+func (p *CalcData) actionDigit(pos int, ctx CalcContext, a1Pos int, v1 string, v2 string, v3 string, v4 string, v5 string, v6 string, v7 string, v8 string, v9 string, v10 string) string {
 	return fmt.Sprintf("%v", a1Pos-1)
 }
 
-func ParseCalc(input string, data *CalcData) (int, error) {
+func ParseCalc(input string, data *CalcData) (ret int, err error) {
 	p := newCalcParser(input, data)
+	defer p.diagnose(&err)
 
-	ret, err := p.stateExpression()
+	ret, err = p.stateExpression()
 	if err == nil {
 		if strings.TrimSpace(p.input[p.pos:]) != "" {
-			err = p.errorStack.coalesce()
-			return ret, err
+			err = p.trailingError()
 		}
 	} else {
-		err = p.errorStack.coalesce()
+		err = p.parseError()
 	}
+	err = p.recoveredErrors(err)
 
 	return ret, err
 }
@@ -516,17 +418,30 @@ type CalcParser struct {
 	lineOffsets []int
 	Data        *CalcData
 	errorStack  *parserErrorStack
+	productions []string                       // the productions currently being parsed, outermost first
+	recovered   []error                        // errors set aside by Recover blocks
+	deferred    []func()                       // actions waiting for the current prediction to be accepted, with -defer
+	undo        []func()                       // functions given to Undo by actions in the current prediction
+	memo        map[CalcmemoKey]*CalcmemoEntry // remembered results of productions, by position
 
 	predictStack []*CalcParser
 }
 
 func newCalcParser(input string, data *CalcData) *CalcParser {
-	return &CalcParser{
+	p := &CalcParser{
 		input:       input,
 		lineOffsets: CalcGenerateLineOffsets(input),
 		Data:        data,
 		errorStack:  &parserErrorStack{},
+		memo:        make(map[CalcmemoKey]*CalcmemoEntry),
 	}
+	if _, ok := interface{}(data).(CalcErrorPolicy); ok {
+		p.errorStack.chains = true
+	}
+	if d := p.diagnostics(); d != nil {
+		d.warnings = nil
+	}
+	return p
 }
 
 func CalcGenerateLineOffsets(input string) []int {
@@ -542,20 +457,201 @@ func CalcGenerateLineOffsets(input string) []int {
 	return ret
 }
 
+// position returns the 1-based line and column of the byte offset pos.
+func (p *CalcParser) position(pos int) (int, int) {
+	return CalcContext{input: p.input, lineOffsets: p.lineOffsets}.position(pos)
+}
+
+// CalcContext describes the input matched by a production, and is given
+// to the production's action.
+type CalcContext struct {
+	Start      int    // byte offset of the match, after any leading whitespace
+	End        int    // byte offset just past the match
+	Production string // name of the matched production
+
+	input       string
+	lineOffsets []int
+	parser      *CalcParser
+}
+
+// context returns the context of production, which was entered at pos and
+// matched up to the current position.
+func (p *CalcParser) context(pos int, production string) CalcContext {
+	start := p.skipSpace(pos)
+	if start > p.pos {
+		start = p.pos
+	}
+	return CalcContext{
+		Start:       start,
+		End:         p.pos,
+		Production:  production,
+		input:       p.input,
+		lineOffsets: p.lineOffsets,
+		parser:      p,
+	}
+}
+
+// Text returns the matched input.
+func (c CalcContext) Text() string {
+	return c.input[c.Start:c.End]
+}
+
+// Undo registers f to be called if the parser backtracks over the matched
+// input, so that an action can reverse its side effects on the data object.
+// Functions are called most recent first. Undo has no effect once the input
+// can no longer be backtracked, including in actions deferred with -defer.
+func (c CalcContext) Undo(f func()) {
+	if c.parser != nil {
+		c.parser.onUndo(f)
+	}
+}
+
+// Line returns the 1-based line the match starts on.
+func (c CalcContext) Line() int {
+	line, _ := c.position(c.Start)
+	return line
+}
+
+// Column returns the 1-based column, in runes, the match starts at.
+func (c CalcContext) Column() int {
+	_, column := c.position(c.Start)
+	return column
+}
+
+func (c CalcContext) position(pos int) (int, int) {
+	lo, hi := 0, len(c.lineOffsets)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if c.lineOffsets[mid] <= pos {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	start := 0
+	if lo > 0 {
+		start = c.lineOffsets[lo-1]
+	}
+	return lo + 1, utf8.RuneCountInString(c.input[start:pos]) + 1
+}
+
+// Pretty returns the error message followed by the line of input containing
+// the error, with a caret under the failing column.
+func (e *CalcParseError) Pretty(input string) string {
+	offsets := CalcGenerateLineOffsets(input)
+	if e.Line < 1 || e.Line > len(offsets) {
+		return e.Error()
+	}
+
+	start := 0
+	if e.Line > 1 {
+		start = offsets[e.Line-2]
+	}
+	end := offsets[e.Line-1] - 1
+	if end > len(input) {
+		end = len(input)
+	}
+	line := strings.TrimSuffix(input[start:end], "\r")
+
+	// keep tabs in the padding so the caret lines up with the input
+	var pad strings.Builder
+	column := 1
+	for _, r := range line {
+		if column >= e.Column {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+		column++
+	}
+
+	return e.Error() + "\n" + line + "\n" + pad.String() + "^"
+}
+
+// sync skips the input past the first of the sync literals found after the
+// farthest error on the error stack. Quoted strings and blocks in braces, such
+// as code, are skipped whole, so a sync literal inside of them is not matched.
+// It returns false, leaving the position unchanged, if none of the sync
+// literals are found.
+func (p *CalcParser) sync(sync ...string) bool {
+	pos := p.errorStack.depth()
+	if pos < p.pos {
+		pos = p.pos
+	}
+
+	var depth int
+	for i := pos; i < len(p.input); i++ {
+		if depth == 0 {
+			for _, v := range sync {
+				if v != "" && strings.HasPrefix(p.input[i:], v) {
+					p.pos = i + len(v)
+					return true
+				}
+			}
+		}
+		switch p.input[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '"', '\x60':
+			i = p.skipQuoted(i)
+		case '\'':
+			// outside of braces, a single quote is more likely an
+			// apostrophe than the start of a character literal.
+			if depth > 0 {
+				i = p.skipQuoted(i)
+			}
+		}
+	}
+	return false
+}
+
+// skipQuoted returns the position of the quote closing the string that starts
+// at pos. Strings in double or single quotes can contain escaped quotes, and
+// end at the end of the line if they are not closed. Strings in back quotes
+// end at the end of the input.
+func (p *CalcParser) skipQuoted(pos int) int {
+	q := p.input[pos]
+	for i := pos + 1; i < len(p.input); i++ {
+		switch c := p.input[i]; {
+		case c == q:
+			return i
+		case c == '\\' && q != '\x60':
+			i++
+		case c == '\n' && q != '\x60':
+			return i
+		}
+	}
+	return len(p.input)
+}
+
+// skipSpace returns the position of the first non-whitespace character at or
+// after pos.
+func (p *CalcParser) skipSpace(pos int) int {
+	for r, s := utf8.DecodeRuneInString(p.input[pos:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[pos:]) {
+		pos += s
+	}
+	return pos
+}
+
 func (p *CalcParser) literal(want string) (string, error) {
 	var errExpected = fmt.Errorf("expected %v", want)
 
-	count := 0
-	for r, s := utf8.DecodeRuneInString(p.input[p.pos+count:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[p.pos+count:]) {
-		count += s
-	}
+	count := p.skipSpace(p.pos) - p.pos
 
 	if strings.HasPrefix(p.input[p.pos+count:], want) {
 		p.pos += count + len(want)
 		return want, nil
 	}
 
-	return "", errExpected
+	return "", &CalcLexError{Offset: count, Err: errExpected}
 }
 
 func (p *CalcParser) predict() *CalcParser {
@@ -566,84 +662,606 @@ func (p *CalcParser) predict() *CalcParser {
 		lineOffsets:  p.lineOffsets,
 		predictStack: p.predictStack,
 		errorStack:   p.errorStack,
+		productions:  p.productions,
+		recovered:    p.recovered,
+		deferred:     p.deferred,
+		undo:         p.undo,
+		memo:         p.memo,
 		Data:         p.Data,
 	}
 }
 
+// backtrack abandons the current prediction, calling the functions given to
+// Undo since it began, most recent first.
 func (p *CalcParser) backtrack() *CalcParser {
+	pp := p.pop()
+	for i := len(p.undo) - 1; i >= len(pp.undo); i-- {
+		p.undo[i]()
+	}
+	return pp
+}
+
+// pop returns the parser the current prediction began from, with the errors
+// recorded since.
+func (p *CalcParser) pop() *CalcParser {
 	pp := p.predictStack[len(p.predictStack)-1]
 	pp.predictStack = pp.predictStack[:len(pp.predictStack)-1]
 	pp.errorStack = p.errorStack
 	return pp
 }
 
+// keep returns the parser the current prediction began from, like backtrack,
+// but without undoing the actions run since, whose results are kept.
+func (p *CalcParser) keep() *CalcParser {
+	pp := p.pop()
+	if len(pp.predictStack) > 0 {
+		pp.undo = p.undo
+	}
+	return pp
+}
+
 func (p *CalcParser) accept() *CalcParser {
-	pp := p.backtrack()
+	pp := p.pop()
 	pp.pos = p.pos
+	pp.recovered = p.recovered
+	pp.deferred = p.deferred
+	pp.undo = p.undo
+	if len(pp.predictStack) == 0 {
+		pp.undo = nil
+		pp.runDeferred()
+	}
 	return pp
 }
 
+// onUndo holds f until the outermost prediction is accepted, calling it if
+// the prediction is backtracked instead. Outside of a prediction, the input
+// can't be backtracked, so f is dropped.
+func (p *CalcParser) onUndo(f func()) {
+	if len(p.predictStack) > 0 {
+		p.undo = append(p.undo, f)
+	}
+}
+
+// queue runs f now if the parser is not inside of a prediction, and otherwise
+// holds it until the outermost prediction is accepted. If the prediction is
+// backtracked instead, f is discarded.
+func (p *CalcParser) queue(f func()) {
+	if len(p.predictStack) == 0 {
+		f()
+		return
+	}
+	p.deferred = append(p.deferred, f)
+}
+
+func (p *CalcParser) runDeferred() {
+	deferred := p.deferred
+	p.deferred = nil
+	for _, f := range deferred {
+		f()
+	}
+}
+
 type parserErrorStack struct {
-	stack []*parseError
+	stack  []*parseError
+	max    int  // the greatest position on the stack
+	chains bool // keep the chain of productions of every error, for an error policy
 }
 
 type parseError struct {
-	err error
+	err         error
+	pos         int
+	productions []string // the productions being parsed when the error was recorded, outermost first
+	expected    string   // the literal, lexer, or production that was expected, if any
+}
+
+// CalcParseError is the error returned by ParseCalc. Offset is the
+// position of the farthest failure in the input, which is a byte offset, or a
+// token index in token mode. Line and Column are the 1-based position of
+// Offset. In token mode, Line is always 1 and Column is the token number.
+// Production is the production the failure was recorded in, and Productions
+// is the chain of productions that led to it, outermost first. Messages are
+// the distinct errors recorded at Offset. Expected is the set of quoted
+// literals, lexer function names, and production names that would have allowed
+// the parse to continue at Offset.
+type CalcParseError struct {
+	Offset      int
+	Line        int
+	Column      int
+	Production  string
+	Productions []string
+	Messages    []string
+	Expected    []string
+
+	other []string // messages that are not expectations, with their positions
+	cause error    // the error given to Fail, if any
+}
+
+// Unwrap returns the error given to CalcDiagnostics.Fail, if the parse was
+// aborted with Fail.
+func (e *CalcParseError) Unwrap() error {
+	return e.cause
+}
+
+// CalcLexError can be returned by lexer functions to report where in their
+// input they failed. Offset is relative to the input given to the lexer
+// function, and is used as the position of the error. Lexer functions that
+// return any other error fail at the start of their input.
+type CalcLexError struct {
+	Offset int
+	Err    error
+}
+
+func (e *CalcLexError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CalcLexError) Unwrap() error {
+	return e.Err
+}
+
+// CalcDiagnostics can be embedded in CalcData to let actions and lexer
+// functions report warnings, and abort the parse with an error, instead of
+// logging or exiting.
+type CalcDiagnostics struct {
+	warnings []CalcWarning
+}
+
+// CalcWarning is a warning reported with CalcDiagnostics.Warn. Line
+// and Column are set when ParseCalc returns.
+type CalcWarning struct {
+	Offset  int
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w CalcWarning) String() string {
+	return fmt.Sprintf("%v at %v:%v", w.Message, w.Line, w.Column)
+}
+
+// Calcfailure is the panic value used by Fail to unwind the parser.
+type Calcfailure struct {
 	pos int
+	err error
+}
+
+// Warn records a warning at the given input position. Warnings do not affect
+// the parse, and are returned by Warnings.
+func (d *CalcDiagnostics) Warn(pos int, msg string) {
+	d.warnings = append(d.warnings, CalcWarning{Offset: pos, Message: msg})
+}
+
+// Fail aborts the parse. ParseCalc returns err as a *CalcParseError at
+// the given input position. Fail does not return.
+func (d *CalcDiagnostics) Fail(pos int, err error) {
+	panic(&Calcfailure{pos: pos, err: err})
+}
+
+// Warnings returns the warnings reported during the most recent parse.
+func (d *CalcDiagnostics) Warnings() []CalcWarning {
+	return d.warnings
+}
+
+func (d *CalcDiagnostics) diagnostics() *CalcDiagnostics {
+	return d
+}
+
+// diagnostics returns the CalcDiagnostics embedded in the parser's data,
+// if any.
+func (p *CalcParser) diagnostics() *CalcDiagnostics {
+	if p.Data == nil {
+		return nil
+	}
+	if d, ok := interface{}(p.Data).(interface{ diagnostics() *CalcDiagnostics }); ok {
+		return d.diagnostics()
+	}
+	return nil
+}
+
+// diagnose is deferred by ParseCalc. It turns a call to Fail into the
+// error returned by ParseCalc, and sets the positions of any warnings.
+func (p *CalcParser) diagnose(err *error) {
+	if r := recover(); r != nil {
+		f, ok := r.(*Calcfailure)
+		if !ok {
+			panic(r)
+		}
+		pos := p.clamp(f.pos)
+		line, column := p.position(pos)
+		*err = p.recoveredErrors(&CalcParseError{
+			Offset:   pos,
+			Line:     line,
+			Column:   column,
+			Messages: []string{f.err.Error()},
+			other:    []string{fmt.Sprintf("%v at %v:%v", f.err, line, column)},
+			cause:    f.err,
+		})
+	}
+
+	if d := p.diagnostics(); d != nil {
+		for i, v := range d.warnings {
+			d.warnings[i].Offset = p.clamp(v.Offset)
+			d.warnings[i].Line, d.warnings[i].Column = p.position(d.warnings[i].Offset)
+		}
+	}
+}
+
+// clamp limits pos to the input. Positions given by actions and lexer
+// functions can be anywhere, but errors and warnings are reported within the
+// input, or just past its end.
+func (p *CalcParser) clamp(pos int) int {
+	if pos < 0 {
+		return 0
+	}
+	if pos > len(p.input) {
+		return len(p.input)
+	}
+	return pos
+}
+
+// CalcParseErrors is returned by ParseCalc when the parser recovered
+// from errors using Recover blocks. It holds every error in the order they
+// were encountered.
+type CalcParseErrors []error
+
+func (e CalcParseErrors) Error() string {
+	var s []string
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap returns the first error, so that errors.As can be used to retrieve
+// it as a *CalcParseError.
+func (e CalcParseErrors) Unwrap() error {
+	return e[0]
+}
+
+func (e *CalcParseError) Error() string {
+	var lines []string
+	if len(e.Expected) == 1 {
+		lines = append(lines, "expected "+e.Expected[0])
+	} else if len(e.Expected) > 1 {
+		lines = append(lines, "expected one of "+strings.Join(e.Expected, ", "))
+	}
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%v at %v:%v", lines[i], e.Line, e.Column)
+	}
+	lines = append(lines, e.other...)
+	return strings.Join(lines, "\n")
+}
+
+// fresh returns an empty error stack for a production to record its errors
+// in.
+func (e *parserErrorStack) fresh() *parserErrorStack {
+	return &parserErrorStack{chains: e.chains}
 }
 
 func (e *parserErrorStack) clear() {
 	e.stack = []*parseError{}
+	e.max = 0
 }
 
 func (e *parserErrorStack) merge(e2 *parserErrorStack) {
 	e.stack = append(e.stack, e2.stack...)
+	if e2.max > e.max {
+		e.max = e2.max
+	}
 }
 
-func (e *parserErrorStack) error(err error, pos int) {
-	e.stack = append(e.stack, &parseError{err: err, pos: pos})
+// truncate replaces the stack with stack, which holds some of its errors.
+func (e *parserErrorStack) truncate(stack []*parseError) {
+	e.stack = stack
+	e.max = 0
+	for _, v := range stack {
+		if v.pos > e.max {
+			e.max = v.pos
+		}
+	}
 }
 
-func (e *parserErrorStack) coalesce() error {
+// push adds v to the stack, recorded in productions. Only the errors at least
+// as far as every error before them can be reported, so the chain of
+// productions, which changes as the parse goes on, is only copied for those,
+// unless an error policy is given every error.
+func (e *parserErrorStack) push(v *parseError, productions []string) {
+	if e.chains || v.pos >= e.max {
+		v.productions = append([]string(nil), productions...)
+	}
+	if v.pos > e.max {
+		e.max = v.pos
+	}
+	e.stack = append(e.stack, v)
+}
+
+func (e *parserErrorStack) error(err error, pos int, productions []string) {
+	e.push(&parseError{err: err, pos: pos}, productions)
+}
+
+// reject records err for an action that rejected the input matched since
+// mark. The errors recorded since mark were ones the parser got past, so they
+// are dropped, leaving only the action's error at pos.
+func (e *parserErrorStack) reject(err error, mark int, pos int, productions []string) {
+	if mark < len(e.stack) {
+		e.truncate(e.stack[:mark])
+	}
+	e.error(err, pos, productions)
+}
+
+// expect records err as a failure to match the given literal, lexer, or
+// production.
+func (e *parserErrorStack) expect(err error, pos int, productions []string, expected string) {
+	e.push(&parseError{err: err, pos: pos, expected: expected}, productions)
+}
+
+// label replaces the expectations on the stack with a single expectation of
+// the innermost production in productions, as long as nothing was recorded
+// past pos. This is used when a production fails without consuming any input,
+// so that the error names the production instead of everything inside of it.
+// The new expectation is recorded against the production's caller.
+func (e *parserErrorStack) label(pos int, productions []string) {
+	if len(productions) == 0 {
+		return
+	}
+	e.relabel(0, pos, productions[:len(productions)-1], productions[len(productions)-1])
+}
+
+// relabel replaces the expectations recorded since mark with a single
+// expectation of label, as long as none of them are past pos.
+func (e *parserErrorStack) relabel(mark int, pos int, productions []string, label string) {
+	for _, v := range e.stack[mark:] {
+		if v.pos > pos {
+			return
+		}
+	}
+
+	stack := e.stack[:mark]
+	for _, v := range e.stack[mark:] {
+		if v.expected == "" {
+			stack = append(stack, v)
+		}
+	}
+	e.truncate(stack)
+	e.push(&parseError{
+		err:      fmt.Errorf("expected %v", label),
+		pos:      pos,
+		expected: label,
+	}, productions)
+}
+
+// farthest returns the errors recorded at the greatest depth, deduplicated and
+// in the order they were recorded.
+func (e *parserErrorStack) farthest() []*parseError {
+	return farthestErrors(e.stack)
+}
+
+// farthestErrors returns the errors in stack recorded at the greatest depth,
+// deduplicated and in the order they were recorded.
+func farthestErrors(stack []*parseError) []*parseError {
 	var bestDepth int
-	var es []error
+	var es []*parseError
 
 COALESCE_OUTER:
-	for _, v := range e.stack {
+	for _, v := range stack {
 		if v.pos > bestDepth {
 			bestDepth = v.pos
-			es = []error{v.err}
+			es = []*parseError{v}
 		} else if v.pos == bestDepth {
 			// deduplicate errors at a given depth
 			for _, w := range es {
-				if w.Error() == v.err.Error() {
+				if w.expected == v.expected && w.err.Error() == v.err.Error() {
 					continue COALESCE_OUTER
 				}
 			}
-			es = append(es, v.err)
+			es = append(es, v)
 		}
 	}
+	return es
+}
+
+func (e *parserErrorStack) coalesce() error {
+	es := e.farthest()
 
 	if len(es) == 0 {
 		return nil
 	} else if len(es) == 1 {
-		return es[0]
+		return es[0].err
 	} else {
 		// print the error stack in reverse order
 		var ret string
 		for i := len(es) - 1; i >= 0; i-- {
-			ret += es[i].Error() + "\n"
+			ret += es[i].err.Error() + "\n"
 		}
 		return errors.New(strings.TrimSpace(ret))
 	}
 }
 
 func (e *parserErrorStack) depth() int {
-	var ret int
-	for _, v := range e.stack {
-		if v.pos > ret {
-			ret = v.pos
+	return e.max
+}
+
+// CalcErrorRecord is an error recorded while parsing. Offset is its
+// position in the input, Productions is the chain of productions it was
+// recorded in, outermost first, and Expected is the literal, lexer function,
+// or production that was expected there, if any.
+type CalcErrorRecord struct {
+	Err         error
+	Offset      int
+	Productions []string
+	Expected    string
+}
+
+// CalcErrorPolicy can be implemented by CalcData to choose which of
+// the recorded errors are reported. ErrorPolicy is given every error recorded
+// while parsing the failed production, in the order they were recorded, and
+// returns the errors to report. The first error returned sets the position of
+// the CalcParseError. If it returns no errors, the default policy
+// (CalcFarthestErrors) is used.
+type CalcErrorPolicy interface {
+	ErrorPolicy(stack []*CalcErrorRecord) []*CalcErrorRecord
+}
+
+// CalcFarthestErrors is the default error policy. It returns the errors
+// in stack recorded at the greatest offset, deduplicated and in the order they
+// were recorded.
+func CalcFarthestErrors(stack []*CalcErrorRecord) []*CalcErrorRecord {
+	var es []*parseError
+	for _, v := range stack {
+		es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
+	}
+	return CalcerrorRecords(farthestErrors(es))
+}
+
+// CalcerrorRecords returns the records of the errors in stack.
+func CalcerrorRecords(stack []*parseError) []*CalcErrorRecord {
+	var r []*CalcErrorRecord
+	for _, v := range stack {
+		r = append(r, &CalcErrorRecord{Err: v.err, Offset: v.pos, Productions: v.productions, Expected: v.expected})
+	}
+	return r
+}
+
+// parseError returns the errors chosen by the error policy from the parser's
+// error stack as a CalcParseError, or nil if there are none.
+func (p *CalcParser) parseError() error {
+	var es []*parseError
+	if policy, ok := interface{}(p.Data).(CalcErrorPolicy); ok {
+		for _, v := range policy.ErrorPolicy(CalcerrorRecords(p.errorStack.stack)) {
+			es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
 		}
 	}
+	if len(es) == 0 {
+		es = p.errorStack.farthest()
+	}
+	if len(es) == 0 {
+		return nil
+	}
+
+	line, column := p.position(es[0].pos)
+	ret := &CalcParseError{
+		Offset:      es[0].pos,
+		Line:        line,
+		Column:      column,
+		Productions: es[0].productions,
+	}
+	if len(ret.Productions) > 0 {
+		ret.Production = ret.Productions[len(ret.Productions)-1]
+	}
+
+EXPECTED_LOOP:
+	for _, v := range es {
+		ret.Messages = append(ret.Messages, v.err.Error())
+		if v.expected == "" {
+			// errors from Error blocks often wrap the default error,
+			// which already has a position
+			var perr *CalcParseError
+			if errors.As(v.err, &perr) {
+				ret.other = append(ret.other, v.err.Error())
+			} else {
+				ret.other = append(ret.other, fmt.Sprintf("%v at %v:%v", v.err, line, column))
+			}
+			continue
+		}
+		for _, w := range ret.Expected {
+			if w == v.expected {
+				continue EXPECTED_LOOP
+			}
+		}
+		ret.Expected = append(ret.Expected, v.expected)
+	}
 	return ret
 }
+
+// recover implements Recover blocks. It skips the input past the first of the
+// sync literals found after the farthest error, and sets the error aside to be
+// returned by ParseCalc. It returns false if none of the sync literals are
+// found.
+func (p *CalcParser) recover(sync ...string) bool {
+	if !p.sync(sync...) {
+		return false
+	}
+	if err := p.parseError(); err != nil {
+		p.recovered = append(p.recovered, err)
+	}
+	p.errorStack.clear()
+	return true
+}
+
+// recoveredErrors returns err along with any errors set aside by Recover
+// blocks. If there is more than one error, they are returned as a
+// CalcParseErrors.
+func (p *CalcParser) recoveredErrors(err error) error {
+	if len(p.recovered) == 0 {
+		return err
+	}
+
+	errs := p.recovered
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return CalcParseErrors(errs)
+}
+
+// errorPos returns the position of a failed term. Literals and lexer functions
+// report failures past the current position by returning a CalcLexError.
+func (p *CalcParser) errorPos(err error) int {
+	var lerr *CalcLexError
+	if errors.As(err, &lerr) {
+		return p.clamp(p.pos + lerr.Offset)
+	}
+	return p.pos
+}
+
+// trailingError returns the error for input left over after a successful
+// parse of the entrypoint.
+func (p *CalcParser) trailingError() error {
+	pos := p.skipSpace(p.pos)
+	if len(p.errorStack.stack) == 0 || p.errorStack.depth() < pos {
+		p.errorStack.error(errors.New("unexpected input"), pos, p.productions)
+	}
+	return p.parseError()
+}
+
+// CalcmemoKey identifies the result of a production at a position.
+type CalcmemoKey struct {
+	id  int
+	pos int
+}
+
+// CalcmemoEntry is a remembered result of a production: its value, the
+// position just past the input it matched, its error, and the errors,
+// deferred actions, and recovered errors it left behind.
+type CalcmemoEntry struct {
+	value     interface{}
+	end       int
+	err       error
+	errors    *parserErrorStack
+	deferred  []func()
+	recovered []error
+}
+
+// CalcerrLeftRecursion fails a left recursive production that calls
+// itself before it has matched anything at a position.
+var CalcerrLeftRecursion = errors.New("left recursion")
+
+// recall moves the parser past the input matched by a remembered result,
+// records its errors again, and queues its deferred actions again, returning
+// its error.
+func (p *CalcParser) recall(m *CalcmemoEntry) error {
+	if m.errors != nil {
+		p.errorStack.merge(m.errors)
+	}
+	p.pos = m.end
+	if m.err != nil {
+		return m.err
+	}
+	p.recovered = append(p.recovered, m.recovered...)
+	for _, f := range m.deferred {
+		p.queue(f)
+	}
+	return nil
+}
@@ -17,6 +17,10 @@
 	func main() {
 		result, err := ParseCalc(os.Args[1], nil)
 		if err != nil {
+			var perr *CalcParseError
+			if errors.As(err, &perr) {
+				log.Fatal(perr.Pretty(os.Args[1]))
+			}
 			log.Fatal(err)
 		}
 		fmt.Println(result)
@@ -24,73 +28,30 @@
 }
 
 type Expression int
-type Term int
 type Factor int
-type AddOp string
-type MultOp string
 type Number int
 type Neg string
 type Digit string
 
-Expression 	= Term { AddOp Term } .			Action {
-								r := v1
-								for i, v := range v2 {
-									switch v {
-									case "+":
-										r = r + v3[i]
-									case "-":
-										r = r - v3[i]
-									}
+Expression 	= Factor .
+		%left "+" "-"
+		%left "*" "/"				Action {
+								switch op {
+								case "+":
+									return lhs + rhs
+								case "-":
+									return lhs - rhs
+								case "*":
+									return lhs * rhs
+								default:
+									return lhs / rhs
 								}
-
-								return r
-							}
-Term 		= Factor { MultOp Factor } .		Action {
-								r := v1
-								for i, v := range v2 {
-									switch v {
-									case "*":
-										r = r * v3[i]
-									case "/":
-										r = r / v3[i]
-									}
-								}
-								return r
-							}
-Factor		= ( "(" Expression ")" ) | Number .	Action {
-								var r int
-								switch a1Pos {
-								case 1:
-									r = v2
-								case 2:
-									r = v4
-								}
-								return r
-							}
-AddOp 		= "+" | "-" .				Action {
-								var r string
-								switch a1Pos {
-								case 1:
-									r = v1
-								case 2:
-									r = v2
-								}
-								return r
-							}
-MultOp 		= "*" | "/" .				Action { 
-								var r string
-								switch a1Pos {
-								case 1:
-									r = v1
-								case 2:
-									r = v2
-								}
-								return r
 							}
-Number 		= [ Neg ] Digit { Digit } .		Action {
+Factor		= "(" Expression ")"			=> { return v2 }
+		| Number				=> { return v1 } .
+Number 		= [ Neg ] Digit { Digit } .		Action fallible {
 								stringNumber := v1 + v2 + strings.Join(v3, "")
-								num, _ := strconv.Atoi(stringNumber)
-								return num
+								return strconv.Atoi(stringNumber)
 							}
 Neg		= "-" .					Action { return v1 }
 Digit 		= "0" | "1" | "2" | "3" | "4" | 
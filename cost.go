@@ -0,0 +1,299 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Cost classes of a production, from cheapest to most expensive.
+const (
+	COST_LINEAR      = iota // the next token always decides what to parse
+	COST_TOKENS             // backtracks, but only over literals and lexer functions
+	COST_BACKTRACK          // re-parses productions a bounded number of times
+	COST_EXPONENTIAL        // re-parses productions that can lead back to itself
+)
+
+// A cost is a rough estimate of how much work a production can repeat when it
+// backtracks. factor is how many times a production called from the same
+// position can be parsed, multiplied over nested backtracking.
+type cost struct {
+	class  int
+	factor int
+	reason string
+}
+
+func (c cost) String() string {
+	switch c.class {
+	case COST_LINEAR:
+		return "linear"
+	case COST_TOKENS:
+		return "linear, backtracks over tokens: " + c.reason
+	case COST_BACKTRACK:
+		return fmt.Sprintf("backtracking, up to %vx: %v", c.factor, c.reason)
+	}
+	return "exponential: " + c.reason
+}
+
+// costs estimates the cost class of each production. A production is linear
+// if the next token always decides what to parse. Otherwise, the productions
+// called by alternatives that can start with the same token, and by options
+// and repetitions that can start with a token that can follow them, may be
+// parsed again from the same position when the parser backtracks. If those
+// productions can lead back to the production, each level of nesting in the
+// input repeats the work again, and parsing can take exponential time, as it
+// can for any production that uses such a production.
+func (p *pbpgData) costs(ff *firstFollow) map[string]cost {
+	reach := make(map[string]map[string]bool)
+	for _, k := range p.orderedStates {
+		reach[k] = map[string]bool{}
+		queue := p.stateMap[k].enumerateNames()
+		for len(queue) > 0 {
+			v := queue[0]
+			queue = queue[1:]
+			if !reach[k][v] {
+				reach[k][v] = true
+				queue = append(queue, p.stateMap[v].enumerateNames()...)
+			}
+		}
+	}
+
+	r := make(map[string]cost)
+	for _, k := range p.orderedStates {
+		c := cost{factor: 1}
+		c.factor = ff.reparse(p.stateMap[k], func(class int, names []string, why string) {
+			switch {
+			case class == COST_TOKENS && c.class < COST_TOKENS:
+				c.class, c.reason = COST_TOKENS, why
+			case class == COST_BACKTRACK:
+				// a left recursive production calling itself at the
+				// same position gets the result it is growing, without
+				// parsing anything again.
+				if p.leaders[k] {
+					var rest []string
+					for _, v := range names {
+						if v != k {
+							rest = append(rest, v)
+						}
+					}
+					if len(rest) == 0 {
+						if c.class < COST_TOKENS {
+							c.class, c.reason = COST_TOKENS, why
+						}
+						return
+					}
+					names = rest
+				}
+				for _, v := range names {
+					if v == k || reach[v][k] {
+						if c.class < COST_EXPONENTIAL {
+							c.class = COST_EXPONENTIAL
+							c.reason = fmt.Sprintf("%v, and %v can lead back to %v", why, v, k)
+						}
+						return
+					}
+				}
+				if c.class < COST_BACKTRACK {
+					c.class, c.reason = COST_BACKTRACK, why
+				}
+			}
+		})
+		r[k] = c
+	}
+
+	// using an exponential production is exponential as well
+	var exponential []string
+	for _, k := range p.orderedStates {
+		if r[k].class == COST_EXPONENTIAL {
+			exponential = append(exponential, k)
+		}
+	}
+	for _, k := range p.orderedStates {
+		if r[k].class == COST_EXPONENTIAL {
+			continue
+		}
+		for _, v := range exponential {
+			if reach[k][v] {
+				r[k] = cost{class: COST_EXPONENTIAL, factor: r[k].factor, reason: "uses " + v}
+				break
+			}
+		}
+	}
+	return r
+}
+
+// reparse calls f for each place in the expression where the parser can
+// backtrack, with the productions it may parse again from the same position,
+// and returns how many times a production can be parsed from the same
+// position, multiplied over nested places.
+func (ff *firstFollow) reparse(e *Expression, f func(class int, names []string, why string)) int {
+	local := 1
+
+	// alternatives that can start with the same token are tried one after
+	// the other, and each one that fails is parsed again by the next.
+	clusters := make([]int, len(e.alternatives))
+	for i := range clusters {
+		clusters[i] = i
+	}
+	for i, a := range e.alternatives {
+		for j, b := range e.alternatives[:i] {
+			if len(ff.firstOfTerms(a.terms).intersect(ff.firstOfTerms(b.terms))) > 0 {
+				old := clusters[i]
+				for x := range clusters {
+					if clusters[x] == old {
+						clusters[x] = clusters[j]
+					}
+				}
+			}
+		}
+	}
+	seen := make(map[int]bool)
+	for i := range e.alternatives {
+		if seen[clusters[i]] {
+			continue
+		}
+		seen[clusters[i]] = true
+		var alts []*Alternative
+		for j, a := range e.alternatives {
+			if clusters[j] == clusters[i] {
+				alts = append(alts, a)
+			}
+		}
+		if len(alts) < 2 {
+			continue
+		}
+		var names []string
+		var s []string
+		for _, a := range alts {
+			s = append(s, a.String())
+		}
+		for _, a := range alts[:len(alts)-1] {
+			names = append(names, a.expression().leftNames(ff.nullable)...)
+		}
+		why := fmt.Sprintf("alternatives %v start with the same token", strings.Join(s, " | "))
+		if len(names) == 0 {
+			f(COST_TOKENS, nil, why)
+			continue
+		}
+		f(COST_BACKTRACK, names, fmt.Sprintf("%v, and re-parse %v", why, strings.Join(dedupe(names), ", ")))
+		if len(alts) > local {
+			local = len(alts)
+		}
+	}
+
+	nested := 1
+	for _, a := range e.alternatives {
+		factor := 1
+		for _, t := range a.terms {
+			if t.option != TERM_GOR {
+				continue
+			}
+			n := ff.reparse(t.gor.expression, f)
+			if t.gor.option != GOR_GROUP && len(ff.firstOf(t.gor.expression).intersect(ff.afterGOR[t])) > 0 {
+				// the body of an option or repetition may be parsed
+				// before the parser finds it has to be skipped.
+				why := fmt.Sprintf("%v can start with a token that can also follow it", t.gor)
+				if names := t.gor.expression.leftNames(ff.nullable); len(names) > 0 {
+					f(COST_BACKTRACK, names, fmt.Sprintf("%v, and re-parse %v", why, strings.Join(dedupe(names), ", ")))
+					n *= 2
+				} else {
+					f(COST_TOKENS, nil, why)
+				}
+			}
+			factor *= n
+		}
+		if factor > nested {
+			nested = factor
+		}
+	}
+	return local * nested
+}
+
+// dedupe returns the names without repeats, in the order they first appear.
+func dedupe(names []string) []string {
+	var r []string
+	seen := make(map[string]bool)
+	for _, v := range names {
+		if !seen[v] {
+			seen[v] = true
+			r = append(r, v)
+		}
+	}
+	return r
+}
+
+// leftFactor returns suggestions for rewriting runs of alternatives that start
+// with the same terms, such as A "+" B | A, so that the shared terms are only
+// parsed once, as in A [ "+" B ]. Only consecutive alternatives are combined,
+// as reordering them could change what is matched.
+func leftFactor(e *Expression) []string {
+	var r []string
+	for i := 0; i < len(e.alternatives); {
+		j := i + 1
+		for j < len(e.alternatives) && len(e.alternatives[j].terms) > 0 && e.alternatives[j].terms[0].sameAs(e.alternatives[i].terms[0]) {
+			j++
+		}
+		if j-i > 1 {
+			if s := factorRun(e.alternatives[i:j]); s != "" {
+				r = append(r, s)
+			}
+		}
+		i = j
+	}
+
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if t.option == TERM_GOR {
+				r = append(r, leftFactor(t.gor.expression)...)
+			}
+		}
+	}
+	return r
+}
+
+// factorRun returns the left factored form of alternatives that share their
+// first term, or "" if an alternative that is only the shared terms comes
+// before others, which can then never match.
+func factorRun(alts []*Alternative) string {
+	n := len(alts[0].terms)
+	for _, a := range alts[1:] {
+		if len(a.terms) < n {
+			n = len(a.terms)
+		}
+		for k := 0; k < n; k++ {
+			if !a.terms[k].sameAs(alts[0].terms[k]) {
+				n = k
+				break
+			}
+		}
+	}
+
+	var prefix, rests, old []string
+	for _, v := range alts[0].terms[:n] {
+		prefix = append(prefix, v.String())
+	}
+	optional := false
+	for i, a := range alts {
+		old = append(old, a.String())
+		if len(a.terms) == n {
+			if i != len(alts)-1 {
+				return ""
+			}
+			optional = true
+			continue
+		}
+		rests = append(rests, (&Alternative{terms: a.terms[n:]}).String())
+	}
+
+	format := "%v ( %v )"
+	if optional {
+		format = "%v [ %v ]"
+	}
+	return fmt.Sprintf("%v can be left factored as "+format, strings.Join(old, " | "), strings.Join(prefix, " "), strings.Join(rests, " | "))
+}
@@ -18,6 +18,7 @@ const (
 	TERM_LITERAL
 	TERM_GOR
 	TERM_LEX
+	TERM_ACTION
 
 	GOR_GROUP = iota
 	GOR_OPTION
@@ -25,30 +26,134 @@ const (
 )
 
 type pbpgData struct {
+	pbpgDiagnostics
+
 	typeMap       map[string]string
 	stateMap      map[string]*Expression // list of productions
-	orderedStates []string               // list of productions in source order
+	orderedStates []string               // list of productions in source order, followed by instances of parameterized productions
 	out           strings.Builder        // output buffer, which is combined with the boiler plate code and formatted on success
 
-	statesUsed map[string]bool // list of states referenced in terms. Used for grammar validation.
+	lines      []line                   // comments and productions in source order, which are emitted once the grammar is parsed
+	macros     map[string]*Production   // parameterized productions
+	inherited  map[string][]Parameter   // runtime parameters of productions that have them
+	macroTypes map[string]*macroType    // types of parameterized productions
+	instances  map[string][]*Production // instances of each parameterized production, in the order they were created
+	leaders    map[string]bool          // left recursive productions whose results are grown from a seed
+	growing    map[string]bool          // other productions in a left recursive cycle, whose results change as a leader's grows
 
 	entryPoint string // The name of the first encountered production.
 }
 
+// A line is either a comment or a production of the grammar.
+type line struct {
+	comment    string
+	production *Production
+}
+
+// A Production is a production of the grammar. Parameterized productions are
+// only emitted as the instances the rest of the grammar uses, so productions
+// are emitted once the whole grammar has been parsed.
+type Production struct {
+	name       string
+	params     []string    // the parameters of a parameterized production
+	inherited  []Parameter // the runtime parameters of the production, given by its callers
+	exp        *Expression
+	action     *ActionBlock
+	errorBlock *ErrorBlock
+	sync       []string           // the literals given in the Recover block
+	call       string             // for instances of parameterized productions, the term that created it
+	precedence []*precedenceLevel // the precedence table of the operators between operands, if any
+	memo       bool               // remember the results of the production at each position, with @memo
+}
+
+// A productionHead is the part of a production up to its closing ".": its
+// name, parameters, and expression. pbpg's own grammar recovers from errors in
+// the head, so that the production's blocks are still skipped as part of it.
+type productionHead struct {
+	name   string
+	params []string
+	memo   bool
+	exp    *Expression
+}
+
+// title returns the name of the production as it is shown in errors, which
+// for an instance of a parameterized production is how it was used.
+func (prod *Production) title() string {
+	if prod.call != "" {
+		return prod.call
+	}
+	return prod.name
+}
+
+// addProduction adds a production to the grammar. The first production that
+// is not parameterized is the entrypoint.
+func (p *pbpgData) addProduction(prod *Production) {
+	p.lines = append(p.lines, line{production: prod})
+	if prod.params != nil {
+		p.macros[prod.name] = prod
+		return
+	}
+	p.stateMap[prod.name] = prod.exp
+	p.orderedStates = append(p.orderedStates, prod.name)
+	if prod.inherited != nil {
+		p.inherited[prod.name] = prod.inherited
+	}
+	if p.entryPoint == "" {
+		p.entryPoint = prod.name
+	}
+}
+
+// emit writes the comments and state functions of the grammar in source
+// order. Parameterized productions are written as each of their instances.
+func (p *pbpgData) emit() {
+	for _, v := range p.lines {
+		if v.production == nil {
+			p.out.WriteString("// " + v.comment + "\n")
+			continue
+		}
+		prods := []*Production{v.production}
+		if v.production.params != nil {
+			prods = p.instances[v.production.name]
+		}
+		for _, prod := range prods {
+			p.emitState(prod)
+		}
+	}
+}
+
 type Variable struct {
 	Value      string
 	T          int
 	Repetition bool
+	Binding    string // the name given to the term in the grammar, if any
+}
+
+// name returns the name of the c'th variable as seen by actions, which is its
+// binding if it has one, and v<c> otherwise.
+func (v *Variable) name(c int) string {
+	if v.Binding != "" {
+		return v.Binding
+	}
+	return fmt.Sprintf("v%v", c)
 }
 
 // verify does the following:
 //  1. Ensures all productions used are defined.
 //  2. All productions defined are used when starting from the entrypoint.
+//  3. No repetition can match without consuming input, and every production
+//     can match some input.
+//  4. Finds the leaders of left recursive productions, and the productions in
+//     their cycles.
+//
+// Parameterized productions are checked through their instances, and must be
+// used at least once.
 func (p *pbpgData) verify() error {
 	// 1
-	for k := range p.statesUsed {
-		if p.stateMap[k] == nil {
-			return fmt.Errorf("state %v not defined", k)
+	for _, k := range p.orderedStates {
+		for _, v := range p.stateMap[k].enumerateNames() {
+			if p.stateMap[v] == nil {
+				return fmt.Errorf("state %v not defined", v)
+			}
 		}
 	}
 
@@ -84,7 +189,24 @@ USED_LOOP:
 		}
 		return fmt.Errorf("state %v defined but not used", k)
 	}
+	for _, v := range p.lines {
+		if v.production != nil && v.production.params != nil && len(p.instances[v.production.name]) == 0 {
+			return fmt.Errorf("state %v defined but not used", v.production.name)
+		}
+	}
+
+	// 3
+	if err := p.checkLoops(); err != nil {
+		return err
+	}
 
+	// 4
+	var err error
+	p.leaders, err = p.findLeaders()
+	if err != nil {
+		return err
+	}
+	p.growing = p.cycleMembers()
 	return nil
 }
 
@@ -132,7 +254,7 @@ func (e *Expression) enumerateNames() []string {
 	for _, a := range e.alternatives {
 		for _, t := range a.terms {
 			if t.option == TERM_NAME {
-				s = append(s, t.name)
+				s = append(s, t.state())
 			} else if t.option == TERM_GOR {
 				s = append(s, t.gor.expression.enumerateNames()...)
 			}
@@ -152,16 +274,19 @@ func (e *Expression) variables() []*Variable {
 			switch t.option {
 			case TERM_NAME:
 				r = append(r, &Variable{
-					T:     TERM_NAME,
-					Value: t.name,
+					T:       TERM_NAME,
+					Value:   t.state(),
+					Binding: t.binding,
 				})
 			case TERM_LITERAL:
 				r = append(r, &Variable{
-					T: TERM_LITERAL,
+					T:       TERM_LITERAL,
+					Binding: t.binding,
 				})
 			case TERM_LEX:
 				r = append(r, &Variable{
-					T: TERM_LEX,
+					T:       TERM_LEX,
+					Binding: t.binding,
 				})
 			case TERM_GOR:
 				rg := t.gor.expression.variables()
@@ -178,6 +303,124 @@ func (e *Expression) variables() []*Variable {
 	return r
 }
 
+// checkBindings returns an error if a term in the expression is bound to a
+// name that is already used by another term or by a runtime parameter of the
+// production, or that can't be used in the generated code, or if the term is
+// a group, option, or repetition. That bound names have a type is checked once
+// the grammar is expanded.
+func (p *pbpgData) checkBindings(exp *Expression, params []Parameter) error {
+	seen := make(map[string]bool)
+	for _, v := range params {
+		seen[v.name] = true
+	}
+	var walk func(e *Expression) error
+	walk = func(e *Expression) error {
+		for _, a := range e.alternatives {
+			for _, t := range a.terms {
+				if t.option == TERM_GOR {
+					if t.binding != "" {
+						return fmt.Errorf("%v: only names, literals, and lexer functions can be bound", t)
+					}
+					if err := walk(t.gor.expression); err != nil {
+						return err
+					}
+					continue
+				}
+				if t.binding == "" {
+					continue
+				}
+				if err := checkName(t.binding); err != nil {
+					return fmt.Errorf("%v: %w", t, err)
+				}
+				if seen[t.binding] {
+					return fmt.Errorf("%v: %v already declared", t, t.binding)
+				}
+				seen[t.binding] = true
+			}
+		}
+		return nil
+	}
+	return walk(exp)
+}
+
+// hasAlternativeActions returns true if any of the expression's alternatives
+// have their own action.
+func (e *Expression) hasAlternativeActions() bool {
+	for _, a := range e.alternatives {
+		if a.action != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// hasMidRuleActions returns true if any of the expression's alternatives have
+// actions between their terms.
+func (e *Expression) hasMidRuleActions() bool {
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if t.option == TERM_ACTION {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkActions returns an error if the expression has an action inside of a
+// group, option, or repetition, or if its alternatives have actions along
+// with the production's action a.
+func checkActions(exp *Expression, a *ActionBlock) error {
+	for _, alt := range exp.alternatives {
+		if len(alt.terms) == 0 {
+			return fmt.Errorf("alternative has an action but no terms")
+		}
+		if alt.action != nil && a != nil {
+			return fmt.Errorf("%v: alternatives cannot have an action when the production has one", alt)
+		}
+		for _, t := range alt.terms {
+			if t.option == TERM_GOR {
+				if err := t.checkNoActions(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// checkNoActions returns an error if the term is or contains an action.
+func (t *Term) checkNoActions() error {
+	switch t.option {
+	case TERM_ACTION:
+		return fmt.Errorf("actions are not allowed in groups, options, or repetitions")
+	case TERM_GOR:
+		for _, alt := range t.gor.expression.alternatives {
+			if alt.action != nil {
+				return fmt.Errorf("%v: actions are not allowed in groups, options, or repetitions", t)
+			}
+			for _, v := range alt.terms {
+				if err := v.checkNoActions(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// literalsOnly returns true if every alternative of the expression is a single
+// literal. Errors in such productions are reported as the literals themselves
+// instead of the production name.
+func (e *Expression) literalsOnly() bool {
+	for _, a := range e.alternatives {
+		if len(a.terms) != 1 || a.terms[0].option != TERM_LITERAL {
+			return false
+		}
+	}
+	return true
+}
+
 func (e *Expression) numAlternativeGroups() int {
 	var r int
 	if len(e.alternatives) > 1 {
@@ -263,22 +506,24 @@ func (p *pbpgData) functionSignature(exp *Expression) string {
 		r += fmt.Sprintf("a%vPos int,", i)
 	}
 
+	// the state function always uses positional names, so bound names only
+	// appear in the signature.
 	for _, v := range vars {
 		switch v.T {
 		case TERM_NAME:
 			if ftype, ok := p.typeMap[v.Value]; ok {
 				if v.Repetition {
-					r += fmt.Sprintf("v%v []%v,", c, ftype)
+					r += fmt.Sprintf("%v []%v,", v.name(c), ftype)
 				} else {
-					r += fmt.Sprintf("v%v %v,", c, ftype)
+					r += fmt.Sprintf("%v %v,", v.name(c), ftype)
 				}
 				c++
 			}
 		case TERM_LITERAL, TERM_LEX:
 			if v.Repetition {
-				r += fmt.Sprintf("v%v []string,", c)
+				r += fmt.Sprintf("%v []string,", v.name(c))
 			} else {
-				r += fmt.Sprintf("v%v string,", c)
+				r += fmt.Sprintf("%v string,", v.name(c))
 			}
 			c++
 		}
@@ -286,9 +531,111 @@ func (p *pbpgData) functionSignature(exp *Expression) string {
 	return strings.TrimSuffix(r, ",")
 }
 
-// An alternative contains one or more terms.
+// numVariables returns the number of variables declared for the expression.
+func (p *pbpgData) numVariables(exp *Expression) int {
+	var n int
+	for _, v := range exp.variables() {
+		if _, ok := p.typeMap[v.Value]; v.T != TERM_NAME || ok {
+			n++
+		}
+	}
+	return n
+}
+
+// alternativeArgs returns the arguments to an action of the i'th alternative
+// of exp that follows the first n terms of the alternative. These are the
+// variables and alternative positions of just those terms, which the action
+// numbers from 1.
+func (p *pbpgData) alternativeArgs(exp *Expression, i int, n int) string {
+	alt := (&Alternative{terms: exp.alternatives[i].terms[:n]}).expression()
+
+	// the production's own alternatives are a1Pos when there is more than
+	// one of them, and the groups inside of them follow, in order.
+	var offset int
+	if len(exp.alternatives) > 1 {
+		offset = 1
+	}
+	for _, v := range exp.alternatives[:i] {
+		offset += v.expression().numAlternativeGroups()
+	}
+	var r []string
+	for j := 1; j <= alt.numAlternativeGroups(); j++ {
+		r = append(r, fmt.Sprintf("a%vPos", j+offset))
+	}
+
+	c := 1
+	for _, v := range exp.alternatives[:i] {
+		c += p.numVariables(v.expression())
+	}
+	for j := 0; j < p.numVariables(alt); j++ {
+		r = append(r, fmt.Sprintf("v%v", c+j))
+	}
+	return strings.Join(r, ",")
+}
+
+// An ActionBlock is the code given in a production's Action block. Blocks
+// declared with "Action fallible" also return an error, which fails the
+// production.
+type ActionBlock struct {
+	code     string
+	fallible bool
+}
+
+// An ErrorBlock is the code given in a production's Error block. Blocks
+// declared with "Error recover" return a substitute value and whether the
+// production recovered, in addition to the error.
+type ErrorBlock struct {
+	code    string
+	recover bool
+}
+
+// An alternative contains one or more terms, and optionally an action that is
+// called when the alternative matches.
 type Alternative struct {
-	terms []*Term
+	terms  []*Term
+	action *ActionBlock
+
+	call string // the code calling the action, once the alternative has matched
+}
+
+// newAlternative returns an alternative of the given terms. If the last term
+// is an action, it becomes the alternative's action.
+func newAlternative(terms []*Term) *Alternative {
+	a := &Alternative{terms: terms}
+	if last := terms[len(terms)-1]; last.option == TERM_ACTION {
+		a.action = last.action
+		a.terms = terms[:len(terms)-1]
+	}
+	return a
+}
+
+// atomic returns true if the alternative is a single literal or lexer
+// function without a fallible action, which cannot fail after consuming
+// input.
+func (a *Alternative) atomic() bool {
+	if a.action != nil && a.action.fallible {
+		return false
+	}
+	return len(a.terms) == 1 && (a.terms[0].option == TERM_LITERAL || a.terms[0].option == TERM_LEX)
+}
+
+// fallible returns true if the alternative's action, or one of the actions
+// between its terms, is fallible.
+func (a *Alternative) fallible() bool {
+	if a.action != nil && a.action.fallible {
+		return true
+	}
+	for _, t := range a.terms {
+		if t.option == TERM_ACTION && t.action.fallible {
+			return true
+		}
+	}
+	return false
+}
+
+// expression returns an expression containing only the alternative.
+func (a *Alternative) expression() *Expression {
+	return &Expression{alternatives: []*Alternative{a}}
 }
 
 func (a *Alternative) String() string {
@@ -299,8 +646,11 @@ func (a *Alternative) String() string {
 	return strings.Join(s, " ")
 }
 
-// A term is either a production name, string literal, lexer function, or a
-// group/option/repetition expression.
+// A term is either a production name, string literal, lexer function, action,
+// or a group/option/repetition expression. Terms can optionally be given a label,
+// which is used in place of the term's own expectations in errors, and terms
+// other than groups, options, and repetitions can be bound to a name, which
+// actions use in place of the term's positional variable.
 type Term struct {
 	option int
 
@@ -308,20 +658,53 @@ type Term struct {
 	literal string
 	gor     *GOR
 	lex     string
+	label   string
+	binding string
+	action  *ActionBlock
+
+	args     []string // arguments given to a production name
+	instance string   // the instance of the parameterized production used, once expanded
+	callArgs string   // the arguments given to a production with runtime parameters, as Go code
+
+	fn     string // the function generated for an action between terms
+	fnArgs string // the arguments fn is called with
 }
 
 func (t *Term) String() string {
+	var s string
+	if t.binding != "" {
+		s = t.binding + ":"
+	}
 	switch t.option {
 	case TERM_NAME:
-		return t.name
+		s += t.name
+		if t.args != nil {
+			s += "(" + strings.Join(t.args, ", ") + ")"
+		}
 	case TERM_LITERAL:
-		return fmt.Sprintf("\"%v\"", t.literal)
+		s += fmt.Sprintf("\"%v\"", t.literal)
 	case TERM_LEX:
-		return t.lex
+		s += t.lex
 	case TERM_GOR:
-		return t.gor.String()
+		s += t.gor.String()
+	case TERM_ACTION:
+		s += "=> { ... }"
+	default:
+		return "invalid term type"
+	}
+	if t.label != "" {
+		s += " @" + strconv.Quote(t.label)
+	}
+	return s
+}
+
+// state returns the name of the production the term refers to, which is an
+// instance of a parameterized production if the term has arguments.
+func (t *Term) state() string {
+	if t.instance != "" {
+		return t.instance
 	}
-	return "invalid term type"
+	return t.name
 }
 
 // A GOR is a group/option/repetition expression, identified by the option
@@ -344,53 +727,148 @@ func (g *GOR) String() string {
 	return "invalid GOR type"
 }
 
-// emitState is called in the action of the Production production. It writes a
+// emitState is called for each production once the grammar is parsed. It writes a
 // state function and walks the given expression (via the visit* functions) to
 // write the logic for the production.
-func (p *pbpgData) emitState(name string, exp *Expression, a, e string) {
-	hasActionError := a != "" || e != ""
+func (p *pbpgData) emitState(prod *Production) {
+	name, exp, a, e, sync := prod.name, prod.exp, prod.action, prod.errorBlock, prod.sync
+	title := prod.title()
+
+	altActions := exp.hasAlternativeActions()
+	hasActionError := a != nil || e != nil || altActions || exp.hasMidRuleActions()
 	// make the comment of the current production
-	p.out.WriteString(fmt.Sprintf("// %v = %v\n", name, exp.String()))
+	p.out.WriteString(fmt.Sprintf("// %v = %v\n", title, exp.String()))
+
+	// runtime parameters are passed along to every action and Error block
+	var params, paramSig []string
+	for _, v := range prod.inherited {
+		params = append(params, v.name)
+		paramSig = append(paramSig, v.name+" "+v.typ)
+	}
 
 	ftype, hasType := p.typeMap[name]
 	var retType string
 	if hasType {
 		retType = ftype + ", "
 	}
-	p.out.WriteString(fmt.Sprintf("func (p *%vParser) state%v() (%v error) {\nvar err error\n", *fPrefix, name, retType))
+	// the body of a leader is called repeatedly by its state function to
+	// grow its result.
+	fname := "state" + name
+	if p.leaders[name] {
+		fname = "grow" + name
+	} else if p.memoized(prod) {
+		fname = "body" + name
+	}
+	p.out.WriteString(fmt.Sprintf("func (p *%vParser) %v(%v) (%v error) {\nvar err error\n", *fPrefix, fname, strings.Join(paramSig, ", "), retType))
 
-	if e != "" {
+	label := !exp.literalsOnly()
+	if hasActionError || label {
 		p.out.WriteString("entryPos := p.pos\n")
 	}
+	if a != nil && a.fallible && prod.precedence == nil {
+		p.out.WriteString("entryMark := len(p.errorStack.stack)\n")
+	}
 
 	if hasType {
 		p.out.WriteString(fmt.Sprintf("var ret %v\n", ftype))
 	}
-	if p.declarators(exp) != "" && hasActionError {
+	// arguments given to productions can use the values of earlier terms, so
+	// they are kept even without an action.
+	calls := p.nameCallArgs(exp)
+	if p.declarators(exp) != "" && (hasActionError || calls) && prod.precedence == nil {
 		p.out.WriteString(p.declarators(exp))
+		if !hasActionError {
+			for _, v := range strings.Split(p.positionalArgs(exp), ",") {
+				p.out.WriteString(fmt.Sprintf("_ = %v\n", v))
+			}
+		} else if a == nil && e == nil {
+			// without an action of the production's own, the variables of
+			// alternatives without an action are never used, and neither
+			// is a1Pos.
+			if len(exp.alternatives) > 1 {
+				p.out.WriteString("_ = a1Pos\n")
+			}
+			for i, alt := range exp.alternatives {
+				if alt.action != nil {
+					continue
+				}
+				for _, v := range strings.Split(p.alternativeArgs(exp, i, len(alt.terms)), ",") {
+					if v != "" {
+						p.out.WriteString(fmt.Sprintf("_ = %v\n", v))
+					}
+				}
+			}
+		}
 	}
 
+	p.out.WriteString(fmt.Sprintf("p.productions = append(p.productions, %v)\n", strconv.Quote(title)))
+
 	if *fDebug {
-		p.out.WriteString(fmt.Sprintf("log.Println(\"state%v\")\n", name))
+		p.out.WriteString(fmt.Sprintf("log.Println(\"state%v\", strings.Join(p.productions, \" > \"))\n", name))
 	}
 
-	p.visitExpression(1, 0, exp, false, hasActionError)
+	pa := joinArgs(append(params, p.positionalArgs(exp))...)
+	if prod.precedence != nil {
+		// the action is called for each operator by the climb function
+		pa = ""
+		p.out.WriteString(fmt.Sprintf("ret, err = p.climb%v(1)\n", name))
+	} else {
+		p.nameActions(prod, params)
+		p.visitExpression(1, 0, exp, false, hasActionError || calls)
+	}
 
-	pa := p.positionalArgs(exp)
-	if a != "" {
-		if hasType {
-			p.out.WriteString(fmt.Sprintf("if err == nil { ret = p.Data.action%v(p.pos, %v) }\n\n", name, pa))
-		} else {
-			p.out.WriteString(fmt.Sprintf("if err == nil { p.Data.action%v(p.pos, %v) }\n\n", name, pa))
+	if a != nil && prod.precedence == nil {
+		p.out.WriteString(fmt.Sprintf("if err == nil { ctx := p.context(entryPos, %v)\n", strconv.Quote(title)))
+		p.out.WriteString(p.actionCall("action"+name, pa, a, hasType, "entryMark"))
+		p.out.WriteString("}\n\n")
+	}
+	if label {
+		p.out.WriteString("if err != nil { p.errorStack.label(p.skipSpace(entryPos), p.productions) }\n\n")
+	}
+	var syncArgs string
+	if len(sync) > 0 {
+		var args []string
+		for _, v := range sync {
+			args = append(args, strconv.Quote(v))
 		}
+		syncArgs = strings.Join(args, ", ")
 	}
-	if e != "" {
+
+	if e != nil {
 		var args string
 		if pa != "" {
 			args = ", " + pa
 		}
-		p.out.WriteString(fmt.Sprintf("if err != nil { terr := p.errorStack.coalesce(); rerr := p.Data.error%v(entryPos, p.errorStack.depth(), terr %v); if rerr != terr { p.errorStack.clear(); p.errorStack.error(rerr, p.pos); } }\n\n", name, args))
+		if e.recover {
+			// a recovered production succeeds with the returned value, and
+			// the returned error, if any, is set aside for Parse to return.
+			// If the production also has a Recover block, the input is
+			// skipped past the sync literal first.
+			p.out.WriteString("if err != nil { terr := p.parseError();")
+			if hasType {
+				p.out.WriteString(fmt.Sprintf("rret, recovered, rerr := p.Data.error%v(entryPos, p.errorStack.depth(), terr %v);", name, args))
+				p.out.WriteString("if recovered { ret = rret }\n")
+			} else {
+				p.out.WriteString(fmt.Sprintf("recovered, rerr := p.Data.error%v(entryPos, p.errorStack.depth(), terr %v);", name, args))
+			}
+			p.out.WriteString("if recovered { err = nil;")
+			if syncArgs != "" {
+				p.out.WriteString(fmt.Sprintf("p.sync(%v);", syncArgs))
+			}
+			p.out.WriteString("p.errorStack.clear(); if rerr != nil { p.recovered = append(p.recovered, rerr) } } else if rerr != terr { p.errorStack.clear(); p.errorStack.error(rerr, p.pos, p.productions); } }\n\n")
+		} else {
+			p.out.WriteString(fmt.Sprintf("if err != nil { terr := p.parseError(); rerr := p.Data.error%v(entryPos, p.errorStack.depth(), terr %v); if rerr != terr { p.errorStack.clear(); p.errorStack.error(rerr, p.pos, p.productions); } }\n\n", name, args))
+		}
+	}
+
+	if syncArgs != "" {
+		p.out.WriteString(fmt.Sprintf("if err != nil && p.recover(%v) { err = nil }\n\n", syncArgs))
+	}
+
+	if *fDebug {
+		p.out.WriteString(fmt.Sprintf("if err != nil { log.Println(\"state%v failed:\", strings.Join(p.productions, \" > \"), p.errorStack.coalesce()) }\n", name))
 	}
+	p.out.WriteString("p.productions = p.productions[:len(p.productions)-1]\n")
 
 	if hasType {
 		p.out.WriteString("return ret, err\n}\n\n")
@@ -398,40 +876,310 @@ func (p *pbpgData) emitState(name string, exp *Expression, a, e string) {
 		p.out.WriteString("return err\n}\n\n")
 	}
 
-	fs := p.functionSignature(exp)
-	if a != "" {
-		if hasType {
-			p.out.WriteString(fmt.Sprintf("func (p *%vData) action%v(pos int, %v) %v { %v\n}\n\n", *fPrefix, name, fs, ftype, a))
-		} else {
-			p.out.WriteString(fmt.Sprintf("func (p *%vData) action%v(pos int, %v) { %v\n}\n\n", *fPrefix, name, fs, a))
+	if p.leaders[name] {
+		p.emitLeader(prod)
+	} else if p.memoized(prod) {
+		p.emitMemo(prod)
+	}
+
+	fs := joinArgs(append(paramSig, p.functionSignature(exp))...)
+	if prod.precedence != nil {
+		p.emitClimb(prod)
+		p.emitActionFunc("action"+name, fmt.Sprintf("lhs %v, op string, rhs %v", ftype, ftype), a, ftype, hasType)
+		fs = ""
+	} else if a != nil {
+		p.emitActionFunc("action"+name, fs, a, ftype, hasType)
+	}
+	for i, alt := range exp.alternatives {
+		for j, t := range alt.terms {
+			if t.option == TERM_ACTION {
+				prefix := (&Alternative{terms: alt.terms[:j]}).expression()
+				p.emitActionFunc(t.fn, joinArgs(append(paramSig, p.functionSignature(prefix))...), t.action, "", false)
+			}
+		}
+		if alt.action != nil {
+			p.emitActionFunc(fmt.Sprintf("action%v_%v", name, i+1), joinArgs(append(paramSig, p.functionSignature(alt.expression()))...), alt.action, ftype, hasType)
 		}
 	}
-	if e != "" {
+	if e != nil {
 		var args string
 		if fs != "" {
 			args = ", " + fs
 		}
-		p.out.WriteString(fmt.Sprintf("func (p *%vData) error%v(pos int, errPos int, err error %v) error {\n%v\n}\n\n", *fPrefix, name, args, e))
+		retType := "error"
+		if e.recover {
+			if hasType {
+				retType = fmt.Sprintf("(%v, bool, error)", ftype)
+			} else {
+				retType = "(bool, error)"
+			}
+		}
+		p.out.WriteString(fmt.Sprintf("func (p *%vData) error%v(pos int, errPos int, err error %v) %v {\n%v\n}\n\n", *fPrefix, name, args, retType, e.code))
+	}
+}
+
+// nameActions names the function of each action between the terms of the
+// alternatives of the production, and the arguments it is called with. The
+// k'th such action in the i'th alternative is action<name>_<i>_<k>. It also
+// sets the call to the action of each alternative that has one, which is
+// action<name>_<i>. Alternative actions are called as soon as their
+// alternative matches, so that one that fails leaves the next alternative to
+// be tried.
+func (p *pbpgData) nameActions(prod *Production, params []string) {
+	name, exp := prod.name, prod.exp
+	_, hasType := p.typeMap[name]
+	for i, alt := range exp.alternatives {
+		k := 1
+		for j, t := range alt.terms {
+			if t.option == TERM_ACTION {
+				t.fn = fmt.Sprintf("action%v_%v_%v", name, i+1, k)
+				t.fnArgs = joinArgs(append(params, p.alternativeArgs(exp, i, j))...)
+				k++
+			}
+		}
+		if alt.action != nil {
+			alt.call = p.actionCall(fmt.Sprintf("action%v_%v", name, i+1), joinArgs(append(params, p.alternativeArgs(exp, i, len(alt.terms)))...), alt.action, hasType, "altMark")
+		}
+	}
+}
+
+// nameCallArgs sets the arguments of each term that calls a production with
+// runtime parameters, replacing the names bound to terms with the variables
+// of the state function. It returns true if there are any such calls.
+func (p *pbpgData) nameCallArgs(exp *Expression) bool {
+	names := make(map[string]string)
+	c := 1
+	for _, v := range exp.variables() {
+		if _, ok := p.typeMap[v.Value]; v.T == TERM_NAME && !ok {
+			continue
+		}
+		if v.Binding != "" {
+			names[v.Binding] = fmt.Sprintf("v%v", c)
+		}
+		c++
+	}
+
+	var calls bool
+	exp.walk(func(t *Term) error {
+		if t.option == TERM_NAME && t.args != nil && t.instance == "" {
+			t.callArgs = substituteIdents(strings.Join(t.args, ", "), names)
+			calls = true
+		}
+		return nil
+	})
+	return calls
+}
+
+// emitLeader emits the state function of a left recursive production, which
+// grows its result from a seed. The result at the current position is first
+// remembered as a failure, so that the production fails when it calls itself
+// before consuming any input, leaving only the alternatives that aren't left
+// recursive to match. The production is then parsed again, with each call to
+// itself at this position returning the previous result, for as long as the
+// result gets longer. The final result is only kept if the production is
+// memoized.
+func (p *pbpgData) emitLeader(prod *Production) {
+	name := prod.name
+	memo := p.memoized(prod)
+	p.emitMemoLookup(prod)
+	if memo {
+		p.out.WriteString("errorStack, undo := p.errorStack, len(p.undo)\np.errorStack = p.errorStack.fresh()\n")
+	}
+	p.out.WriteString(fmt.Sprintf("m := &%vmemoEntry{end: p.pos, err: %verrLeftRecursion}\n", *fPrefix, *fPrefix))
+	p.out.WriteString("p.memo[key] = m\n")
+	p.out.WriteString("for {\n")
+	p.out.WriteString("p = p.predict()\n")
+	p.out.WriteString("deferred, recovered := len(p.deferred), len(p.recovered)\n")
+	if _, ok := p.typeMap[name]; ok {
+		p.out.WriteString(fmt.Sprintf("v, err := p.grow%v()\n", name))
+	} else {
+		p.out.WriteString("var v interface{}\n")
+		p.out.WriteString(fmt.Sprintf("err := p.grow%v()\n", name))
+	}
+	p.out.WriteString("if err != nil || (m.err == nil && p.pos <= m.end) { p = p.backtrack(); if m.err != nil { m.err = err; m.end = p.pos }; break }\n")
+	p.out.WriteString(fmt.Sprintf("m = &%vmemoEntry{value: v, end: p.pos, deferred: append([]func(){}, p.deferred[deferred:]...), recovered: append([]error{}, p.recovered[recovered:]...)}\n", *fPrefix))
+	p.out.WriteString("p.memo[key] = m\n")
+	// the actions of the grown result have run, and the next round builds
+	// on the result.
+	p.out.WriteString("p = p.keep()\n")
+	p.out.WriteString("}\n")
+	if memo {
+		// a result whose actions can be undone isn't kept, as recalling
+		// it after they were undone would not run them again.
+		p.out.WriteString("m.errors = p.errorStack\np.errorStack = errorStack\n")
+		p.out.WriteString("if len(p.undo) > undo { delete(p.memo, key) }\n")
+	} else {
+		p.out.WriteString("delete(p.memo, key)\n")
+	}
+	p.emitMemoRecall(prod)
+}
+
+// emitMemo emits the state function of a memoized production, which parses
+// the production once at each position, and then returns the remembered
+// result, with the errors, deferred actions, and recovered errors of the
+// production, each time it is parsed at that position again.
+func (p *pbpgData) emitMemo(prod *Production) {
+	name := prod.name
+	p.emitMemoLookup(prod)
+	p.out.WriteString("errorStack, deferred, recovered, undo := p.errorStack, len(p.deferred), len(p.recovered), len(p.undo)\n")
+	p.out.WriteString("p.errorStack = p.errorStack.fresh()\n")
+	if _, ok := p.typeMap[name]; ok {
+		p.out.WriteString(fmt.Sprintf("v, err := p.body%v()\n", name))
+	} else {
+		p.out.WriteString("var v interface{}\n")
+		p.out.WriteString(fmt.Sprintf("err := p.body%v()\n", name))
+	}
+	// a result whose actions can be undone isn't remembered, as recalling
+	// it after they were undone would not run them again.
+	p.out.WriteString(fmt.Sprintf("if len(p.undo) == undo { p.memo[key] = &%vmemoEntry{value: v, end: p.pos, err: err, errors: p.errorStack, deferred: append([]func(){}, p.deferred[deferred:]...), recovered: append([]error{}, p.recovered[recovered:]...)} }\n", *fPrefix))
+	p.out.WriteString("errorStack.merge(p.errorStack)\np.errorStack = errorStack\n")
+	if _, ok := p.typeMap[name]; ok {
+		p.out.WriteString("return v, err\n}\n\n")
+	} else {
+		p.out.WriteString("return err\n}\n\n")
+	}
+}
+
+// emitMemoLookup opens the state function of a production whose results are
+// remembered, returning the remembered result at the current position if
+// there is one.
+func (p *pbpgData) emitMemoLookup(prod *Production) {
+	name := prod.name
+	ftype, hasType := p.typeMap[name]
+	var id int
+	for i, v := range p.orderedStates {
+		if v == name {
+			id = i
+		}
+	}
+
+	if hasType {
+		p.out.WriteString(fmt.Sprintf("func (p *%vParser) state%v() (%v, error) {\n", *fPrefix, name, ftype))
+	} else {
+		p.out.WriteString(fmt.Sprintf("func (p *%vParser) state%v() error {\n", *fPrefix, name))
+	}
+	p.out.WriteString(fmt.Sprintf("key := %vmemoKey{id: %v, pos: p.pos}\n", *fPrefix, id))
+	p.out.WriteString("if m, ok := p.memo[key]; ok {\n")
+	p.emitMemoRecall(prod)
+}
+
+// emitMemoRecall returns the remembered result m and closes the block.
+func (p *pbpgData) emitMemoRecall(prod *Production) {
+	if ftype, ok := p.typeMap[prod.name]; ok {
+		p.out.WriteString(fmt.Sprintf("v, _ := m.value.(%v)\n", ftype))
+		p.out.WriteString("return v, p.recall(m)\n}\n\n")
+	} else {
+		p.out.WriteString("return p.recall(m)\n}\n\n")
+	}
+}
+
+// memoized returns true if the results of the production are remembered at
+// each position, with -memo or @memo. The results of productions with
+// runtime parameters depend on their arguments, and the results of the
+// productions in a left recursive cycle other than its leader change with
+// each round of growing the leader's result, so they are never remembered.
+func (p *pbpgData) memoized(prod *Production) bool {
+	return (*fMemo || prod.memo) && prod.inherited == nil && !p.growing[prod.name]
+}
+
+// joinArgs joins the non-empty lists of arguments or parameters.
+func joinArgs(args ...string) string {
+	var r []string
+	for _, v := range args {
+		if v != "" {
+			r = append(r, v)
+		}
 	}
+	return strings.Join(r, ", ")
 }
 
-func (p *pbpgData) visitExpression(vCount int, aCount int, exp *Expression, rep bool, hasAction bool) int {
+// actionCall returns the call to the action function fn with the given
+// arguments. It must be written where err is nil and ctx is declared.
+func (p *pbpgData) actionCall(fn string, args string, a *ActionBlock, hasType bool, mark string) string {
+	switch {
+	case a.fallible:
+		// an error from a fallible action fails the production as if one
+		// of its terms had failed, and replaces the errors recorded since
+		// mark, which the parser got past.
+		var r string
+		if hasType {
+			r = fmt.Sprintf("ret, err = p.Data.%v(p.pos, ctx, %v)\n", fn, args)
+		} else {
+			r = fmt.Sprintf("err = p.Data.%v(p.pos, ctx, %v)\n", fn, args)
+		}
+		return r + fmt.Sprintf("if err != nil { p.errorStack.reject(err, %v, p.pos, p.productions) }\n", mark)
+	case hasType:
+		return fmt.Sprintf("ret = p.Data.%v(p.pos, ctx, %v)\n", fn, args)
+	case *fDefer:
+		// actions without a type can only have side effects, so they are
+		// held until the input they matched can't be backtracked.
+		return fmt.Sprintf("pos := p.pos; p.queue(func() { p.Data.%v(pos, ctx, %v) })\n", fn, args)
+	default:
+		return fmt.Sprintf("p.Data.%v(p.pos, ctx, %v)\n", fn, args)
+	}
+}
+
+// emitActionFunc writes the action function fn with the given signature.
+func (p *pbpgData) emitActionFunc(fn string, signature string, a *ActionBlock, ftype string, hasType bool) {
+	var retType string
+	switch {
+	case hasType && a.fallible:
+		retType = fmt.Sprintf("(%v, error)", ftype)
+	case hasType:
+		retType = ftype
+	case a.fallible:
+		retType = "error"
+	}
+	p.out.WriteString(fmt.Sprintf("func (p *%vData) %v(pos int, ctx %vContext, %v) %v { %v\n}\n\n", *fPrefix, fn, *fPrefix, signature, retType, a.code))
+}
+
+// visitExpression writes the logic of an expression, and returns the number
+// of the next variable and of the last alternative position used. Alternative
+// positions are numbered in the order of numAlternativeGroups: an expression
+// with several alternatives before the groups inside of it.
+func (p *pbpgData) visitExpression(vCount int, aCount int, exp *Expression, rep bool, hasAction bool) (int, int) {
 	var needPos bool
+	pos := aCount
 	if len(exp.alternatives) > 1 && hasAction {
 		aCount++
+		pos = aCount
 		needPos = true
 	}
 
 	for i, v := range exp.alternatives {
 		if needPos {
-			p.out.WriteString(fmt.Sprintf("a%vPos = %v\n", aCount, i+1))
+			p.out.WriteString(fmt.Sprintf("a%vPos = %v\n", pos, i+1))
+		}
+		// an alternative that can fail after consuming input is tried in a
+		// prediction, so that the next alternative starts from the same
+		// position and its actions are undone.
+		predict := i < len(exp.alternatives)-1 && !v.atomic()
+		if predict {
+			p.out.WriteString("p = p.predict()\n")
+		}
+		// the errors recorded while matching an alternative are dropped if
+		// one of its actions rejects it.
+		fallible := v.fallible()
+		if fallible {
+			p.out.WriteString("{ altMark := len(p.errorStack.stack)\n")
+		}
+		vCount, aCount = p.visitAlternative(vCount, aCount, v, rep, hasAction)
+		if v.call != "" {
+			p.out.WriteString("if err == nil { ctx := p.context(entryPos, p.productions[len(p.productions)-1])\n")
+			p.out.WriteString(v.call)
+			p.out.WriteString("}\n")
+		}
+		if fallible {
+			p.out.WriteString("}\n")
+		}
+		if predict {
+			p.out.WriteString("if err != nil { p = p.backtrack() } else { p = p.accept() }\n")
 		}
-		vCount = p.visitAlternative(vCount, aCount, v, rep, hasAction)
 		if i < len(exp.alternatives)-1 {
 			p.out.WriteString("if err != nil { \n")
 		} else if needPos {
 			p.out.WriteString("if err != nil { \n")
-			p.out.WriteString(fmt.Sprintf("a%vPos = -1\n", aCount))
+			p.out.WriteString(fmt.Sprintf("a%vPos = -1\n", pos))
 		}
 	}
 	for i := range exp.alternatives {
@@ -439,12 +1187,12 @@ func (p *pbpgData) visitExpression(vCount int, aCount int, exp *Expression, rep
 			p.out.WriteString("}\n")
 		}
 	}
-	return vCount
+	return vCount, aCount
 }
 
-func (p *pbpgData) visitAlternative(vCount int, aCount int, alt *Alternative, rep bool, hasAction bool) int {
+func (p *pbpgData) visitAlternative(vCount int, aCount int, alt *Alternative, rep bool, hasAction bool) (int, int) {
 	for i, v := range alt.terms {
-		vCount = p.visitTerm(vCount, aCount, v, rep, hasAction)
+		vCount, aCount = p.visitTerm(vCount, aCount, v, rep, hasAction)
 		if i < len(alt.terms)-1 {
 			p.out.WriteString("if err == nil {\n")
 		}
@@ -454,34 +1202,38 @@ func (p *pbpgData) visitAlternative(vCount int, aCount int, alt *Alternative, re
 			p.out.WriteString("}\n")
 		}
 	}
-	return vCount
+	return vCount, aCount
 }
 
-func (p *pbpgData) visitTerm(vCount int, aCount int, term *Term, rep bool, hasAction bool) int {
+func (p *pbpgData) visitTerm(vCount int, aCount int, term *Term, rep bool, hasAction bool) (int, int) {
+	// options and repetitions never fail, so their labels are applied to
+	// each attempt instead of the whole term.
+	labelTerm := term.label != "" && (term.option != TERM_GOR || term.gor.option == GOR_GROUP)
+	if labelTerm {
+		p.openLabel()
+	}
+
 	switch term.option {
 	case TERM_NAME:
 		// states get their own error stack
-		p.out.WriteString(fmt.Sprintf("v%vErrorStack := p.errorStack; p.errorStack = &parserErrorStack{} ;\n", vCount))
+		p.out.WriteString(fmt.Sprintf("v%vErrorStack := p.errorStack; p.errorStack = p.errorStack.fresh() ;\n", vCount))
 		errorCount := vCount
+		state := term.state()
 
-		if _, ok := p.typeMap[term.name]; ok {
+		if _, ok := p.typeMap[state]; ok {
 			if hasAction {
 				if rep {
-					p.out.WriteString(fmt.Sprintf("v%vtemp, err = p.state%v()\n", vCount, term.name))
+					p.out.WriteString(fmt.Sprintf("v%vtemp, err = p.state%v(%v)\n", vCount, state, term.callArgs))
 				} else {
-					p.out.WriteString(fmt.Sprintf("v%v, err = p.state%v()\n", vCount, term.name))
+					p.out.WriteString(fmt.Sprintf("v%v, err = p.state%v(%v)\n", vCount, state, term.callArgs))
 				}
 			} else {
-				p.out.WriteString(fmt.Sprintf("_, err = p.state%v()\n", term.name))
+				p.out.WriteString(fmt.Sprintf("_, err = p.state%v(%v)\n", state, term.callArgs))
 			}
 			vCount++
 		} else {
-			p.out.WriteString(fmt.Sprintf("err = p.state%v()\n", term.name))
-		}
-		if p.statesUsed == nil {
-			p.statesUsed = make(map[string]bool)
+			p.out.WriteString(fmt.Sprintf("err = p.state%v(%v)\n", state, term.callArgs))
 		}
-		p.statesUsed[term.name] = true
 
 		p.out.WriteString(fmt.Sprintf("if p.errorStack.coalesce() != nil { v%vErrorStack.merge(p.errorStack) }; p.errorStack = v%vErrorStack\n", errorCount, errorCount))
 	case TERM_LITERAL:
@@ -494,144 +1246,606 @@ func (p *pbpgData) visitTerm(vCount int, aCount int, term *Term, rep bool, hasAc
 		} else {
 			p.out.WriteString(fmt.Sprintf("_, err = p.literal(%v)\n", strconv.Quote(term.literal)))
 		}
-		p.out.WriteString("if err != nil { p.errorStack.error(err, p.pos) }\n")
+		p.out.WriteString(fmt.Sprintf("if err != nil { p.errorStack.expect(err, p.errorPos(err), p.productions, %v) }\n", strconv.Quote(strconv.Quote(term.literal))))
 		vCount++
 	case TERM_GOR:
-		vCount = p.visitGOR(vCount, aCount, term.gor, rep, hasAction)
+		vCount, aCount = p.visitGOR(vCount, aCount, term.gor, term.label, rep, hasAction)
+	case TERM_ACTION:
+		// actions between terms always run immediately, as they may change
+		// how the rest of the alternative is parsed.
+		p.out.WriteString("{ ctx := p.context(entryPos, p.productions[len(p.productions)-1])\n")
+		if term.action.fallible {
+			p.out.WriteString(fmt.Sprintf("err = p.Data.%v(p.pos, ctx, %v)\n", term.fn, term.fnArgs))
+			p.out.WriteString("if err != nil { p.errorStack.reject(err, altMark, p.pos, p.productions) }\n")
+		} else {
+			p.out.WriteString(fmt.Sprintf("p.Data.%v(p.pos, ctx, %v)\n", term.fn, term.fnArgs))
+		}
+		p.out.WriteString("}\n")
 	case TERM_LEX:
 		if hasAction {
 			if rep {
-				p.out.WriteString(fmt.Sprintf("{ n, lexeme, lerr := p.Data.lex%v(p.input[p.pos:]); p.pos += n; if lerr != nil { err = lerr } else { err = nil; v%vtemp = lexeme }; };", term.lex, vCount))
+				p.out.WriteString(fmt.Sprintf("{ n, lexeme, lerr := p.Data.lex%v(p.input[p.pos:]); if lerr != nil { err = lerr } else { err = nil; p.pos += n; v%vtemp = lexeme }; };", term.lex, vCount))
 			} else {
-				p.out.WriteString(fmt.Sprintf("{ n, lexeme, lerr := p.Data.lex%v(p.input[p.pos:]); p.pos += n; if lerr != nil { err = lerr } else { err = nil; v%v = lexeme }; };", term.lex, vCount))
+				p.out.WriteString(fmt.Sprintf("{ n, lexeme, lerr := p.Data.lex%v(p.input[p.pos:]); if lerr != nil { err = lerr } else { err = nil; p.pos += n; v%v = lexeme }; };", term.lex, vCount))
 			}
 		} else {
-			p.out.WriteString(fmt.Sprintf("{ n, _, lerr := p.Data.lex%v(p.input[p.pos:]); p.pos += n; if lerr != nil { err = lerr } else { err = nil; }; };", term.lex))
+			p.out.WriteString(fmt.Sprintf("{ n, _, lerr := p.Data.lex%v(p.input[p.pos:]); if lerr != nil { err = lerr } else { err = nil; p.pos += n }; };", term.lex))
 		}
 		vCount++
-		p.out.WriteString("if err != nil { p.errorStack.error(err, p.pos) }\n")
+		p.out.WriteString(fmt.Sprintf("if err != nil { p.errorStack.expect(err, p.errorPos(err), p.productions, %v) }\n", strconv.Quote(term.lex)))
+	}
+
+	if labelTerm {
+		p.closeLabel(term.label)
 	}
-	return vCount
+	return vCount, aCount
+}
+
+// openLabel starts a block that records where a labeled term or attempt
+// begins. closeLabel ends the block, replacing the expectations recorded
+// inside of it with the label if it failed without getting past its start.
+func (p *pbpgData) openLabel() {
+	p.out.WriteString("{ labelPos := p.skipSpace(p.pos); labelMark := len(p.errorStack.stack)\n")
+}
+
+func (p *pbpgData) closeLabel(label string) {
+	p.out.WriteString(fmt.Sprintf("if err != nil { p.errorStack.relabel(labelMark, labelPos, p.productions, %v) }\n}\n", strconv.Quote(label)))
 }
 
 // Subexpressions, which are visited in groups, must create a new parser, which
 // then attempts to evaluate the expression. If it fails, the parent parser can
 // discard the result (backtracking), or accept it by merging the parser states
 // together.
-func (p *pbpgData) visitGOR(vCount int, aCount int, gor *GOR, rep bool, hasAction bool) int {
+func (p *pbpgData) visitGOR(vCount int, aCount int, gor *GOR, label string, rep bool, hasAction bool) (int, int) {
 	switch gor.option {
 	case GOR_GROUP:
 		p.out.WriteString("// group\n")
 		p.out.WriteString("p = p.predict()\n")
-		vCount = p.visitExpression(vCount, aCount, gor.expression, rep, hasAction)
+		vCount, aCount = p.visitExpression(vCount, aCount, gor.expression, rep, hasAction)
 		p.out.WriteString("if err != nil { p = p.backtrack() } else { p = p.accept() }\n")
 	case GOR_OPTION:
 		p.out.WriteString("// option\n")
 		p.out.WriteString("p = p.predict()\n")
-		vCount = p.visitExpression(vCount, aCount, gor.expression, rep, hasAction)
+		if label != "" {
+			p.openLabel()
+		}
+		vCount, aCount = p.visitExpression(vCount, aCount, gor.expression, rep, hasAction)
+		if label != "" {
+			p.closeLabel(label)
+		}
 		p.out.WriteString("if err != nil { p = p.backtrack(); err = nil } else { p = p.accept() }\n")
 	case GOR_REPETITION:
 		p.out.WriteString("// repetition\n")
 		p.out.WriteString("for {\n")
 		p.out.WriteString("p = p.predict()\n")
+		// an iteration that consumes nothing ends the repetition, as it
+		// would otherwise match forever.
+		p.out.WriteString("repPos := p.pos\n")
+		if label != "" {
+			p.openLabel()
+		}
 		vStart := vCount
-		vCount = p.visitExpression(vCount, aCount, gor.expression, true, hasAction)
+		vCount, aCount = p.visitExpression(vCount, aCount, gor.expression, true, hasAction)
+		if label != "" {
+			p.closeLabel(label)
+		}
 		var acceptAppends string
 		if hasAction {
 			for i := vStart; i < vCount; i++ {
 				acceptAppends += fmt.Sprintf("v%v = append(v%v, v%vtemp)\n", i, i, i)
 			}
 		}
-		p.out.WriteString(fmt.Sprintf("if err != nil { p = p.backtrack(); err = nil; break } else { %v p = p.accept() }\n", acceptAppends))
+		p.out.WriteString(fmt.Sprintf("if err != nil || p.pos == repPos { p = p.backtrack(); err = nil; break } else { %v p = p.accept() }\n", acceptAppends))
 		p.out.WriteString("}\n")
 	}
-	return vCount
+	return vCount, aCount
 }
 
 var errorRecovery = `
 
 type parserErrorStack struct {
-	stack []*parseError
+	stack  []*parseError
+	max    int  // the greatest position on the stack
+	chains bool // keep the chain of productions of every error, for an error policy
 }
 
 type parseError struct {
-	err error
-	pos int
+	err         error
+	pos         int
+	productions []string // the productions being parsed when the error was recorded, outermost first
+	expected    string   // the literal, lexer, or production that was expected, if any
 }
 
-func (e *parserErrorStack) clear() {
-	e.stack = []*parseError{}
+// _PREFIX_ParseError is the error returned by Parse_PREFIX_. Offset is the
+// position of the farthest failure in the input, which is a byte offset, or a
+// token index in token mode. Line and Column are the 1-based position of
+// Offset. In token mode, Line is always 1 and Column is the token number.
+// Production is the production the failure was recorded in, and Productions
+// is the chain of productions that led to it, outermost first. Messages are
+// the distinct errors recorded at Offset. Expected is the set of quoted
+// literals, lexer function names, and production names that would have allowed
+// the parse to continue at Offset.
+type _PREFIX_ParseError struct {
+	Offset     int
+	Line       int
+	Column     int
+	Production  string
+	Productions []string
+	Messages    []string
+	Expected    []string
+
+	other []string // messages that are not expectations, with their positions
+	cause error    // the error given to Fail, if any
 }
 
-func (e *parserErrorStack) merge(e2 *parserErrorStack) {
-	e.stack = append(e.stack, e2.stack...)
+// Unwrap returns the error given to _PREFIX_Diagnostics.Fail, if the parse was
+// aborted with Fail.
+func (e *_PREFIX_ParseError) Unwrap() error {
+	return e.cause
 }
 
-func (e *parserErrorStack) error(err error, pos int) {
-	e.stack = append(e.stack, &parseError{ err: err, pos: pos })
+// _PREFIX_LexError can be returned by lexer functions to report where in their
+// input they failed. Offset is relative to the input given to the lexer
+// function, and is used as the position of the error. Lexer functions that
+// return any other error fail at the start of their input.
+type _PREFIX_LexError struct {
+	Offset int
+	Err    error
 }
 
-func (e *parserErrorStack) coalesce() error {
-	var bestDepth int
-	var es []error
+func (e *_PREFIX_LexError) Error() string {
+	return e.Err.Error()
+}
 
-COALESCE_OUTER:
-	for _, v := range e.stack {
-		if v.pos > bestDepth {
-			bestDepth = v.pos
-			es = []error{v.err}
-		} else if v.pos == bestDepth {
-			// deduplicate errors at a given depth
+func (e *_PREFIX_LexError) Unwrap() error {
+	return e.Err
+}
+
+// _PREFIX_Diagnostics can be embedded in _PREFIX_Data to let actions and lexer
+// functions report warnings, and abort the parse with an error, instead of
+// logging or exiting.
+type _PREFIX_Diagnostics struct {
+	warnings []_PREFIX_Warning
+}
+
+// _PREFIX_Warning is a warning reported with _PREFIX_Diagnostics.Warn. Line
+// and Column are set when Parse_PREFIX_ returns.
+type _PREFIX_Warning struct {
+	Offset  int
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w _PREFIX_Warning) String() string {
+	return fmt.Sprintf("%v at %v:%v", w.Message, w.Line, w.Column)
+}
+
+// _PREFIX_failure is the panic value used by Fail to unwind the parser.
+type _PREFIX_failure struct {
+	pos int
+	err error
+}
+
+// Warn records a warning at the given input position. Warnings do not affect
+// the parse, and are returned by Warnings.
+func (d *_PREFIX_Diagnostics) Warn(pos int, msg string) {
+	d.warnings = append(d.warnings, _PREFIX_Warning{Offset: pos, Message: msg})
+}
+
+// Fail aborts the parse. Parse_PREFIX_ returns err as a *_PREFIX_ParseError at
+// the given input position. Fail does not return.
+func (d *_PREFIX_Diagnostics) Fail(pos int, err error) {
+	panic(&_PREFIX_failure{pos: pos, err: err})
+}
+
+// Warnings returns the warnings reported during the most recent parse.
+func (d *_PREFIX_Diagnostics) Warnings() []_PREFIX_Warning {
+	return d.warnings
+}
+
+func (d *_PREFIX_Diagnostics) diagnostics() *_PREFIX_Diagnostics {
+	return d
+}
+
+// diagnostics returns the _PREFIX_Diagnostics embedded in the parser's data,
+// if any.
+func (p *_PREFIX_Parser) diagnostics() *_PREFIX_Diagnostics {
+	if p.Data == nil {
+		return nil
+	}
+	if d, ok := interface{}(p.Data).(interface{ diagnostics() *_PREFIX_Diagnostics }); ok {
+		return d.diagnostics()
+	}
+	return nil
+}
+
+// diagnose is deferred by Parse_PREFIX_. It turns a call to Fail into the
+// error returned by Parse_PREFIX_, and sets the positions of any warnings.
+func (p *_PREFIX_Parser) diagnose(err *error) {
+	if r := recover(); r != nil {
+		f, ok := r.(*_PREFIX_failure)
+		if !ok {
+			panic(r)
+		}
+		pos := p.clamp(f.pos)
+		line, column := p.position(pos)
+		*err = p.recoveredErrors(&_PREFIX_ParseError{
+			Offset:   pos,
+			Line:     line,
+			Column:   column,
+			Messages: []string{f.err.Error()},
+			other:    []string{fmt.Sprintf("%v at %v:%v", f.err, line, column)},
+			cause:    f.err,
+		})
+	}
+
+	if d := p.diagnostics(); d != nil {
+		for i, v := range d.warnings {
+			d.warnings[i].Offset = p.clamp(v.Offset)
+			d.warnings[i].Line, d.warnings[i].Column = p.position(d.warnings[i].Offset)
+		}
+	}
+}
+
+// clamp limits pos to the input. Positions given by actions and lexer
+// functions can be anywhere, but errors and warnings are reported within the
+// input, or just past its end.
+func (p *_PREFIX_Parser) clamp(pos int) int {
+	if pos < 0 {
+		return 0
+	}
+	if pos > len(p.input) {
+		return len(p.input)
+	}
+	return pos
+}
+
+// _PREFIX_ParseErrors is returned by Parse_PREFIX_ when the parser recovered
+// from errors using Recover blocks. It holds every error in the order they
+// were encountered.
+type _PREFIX_ParseErrors []error
+
+func (e _PREFIX_ParseErrors) Error() string {
+	var s []string
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap returns the first error, so that errors.As can be used to retrieve
+// it as a *_PREFIX_ParseError.
+func (e _PREFIX_ParseErrors) Unwrap() error {
+	return e[0]
+}
+
+func (e *_PREFIX_ParseError) Error() string {
+	var lines []string
+	if len(e.Expected) == 1 {
+		lines = append(lines, "expected " + e.Expected[0])
+	} else if len(e.Expected) > 1 {
+		lines = append(lines, "expected one of " + strings.Join(e.Expected, ", "))
+	}
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%v at %v:%v", lines[i], e.Line, e.Column)
+	}
+	lines = append(lines, e.other...)
+	return strings.Join(lines, "\n")
+}
+
+// fresh returns an empty error stack for a production to record its errors
+// in.
+func (e *parserErrorStack) fresh() *parserErrorStack {
+	return &parserErrorStack{chains: e.chains}
+}
+
+func (e *parserErrorStack) clear() {
+	e.stack = []*parseError{}
+	e.max = 0
+}
+
+func (e *parserErrorStack) merge(e2 *parserErrorStack) {
+	e.stack = append(e.stack, e2.stack...)
+	if e2.max > e.max {
+		e.max = e2.max
+	}
+}
+
+// truncate replaces the stack with stack, which holds some of its errors.
+func (e *parserErrorStack) truncate(stack []*parseError) {
+	e.stack = stack
+	e.max = 0
+	for _, v := range stack {
+		if v.pos > e.max {
+			e.max = v.pos
+		}
+	}
+}
+
+// push adds v to the stack, recorded in productions. Only the errors at least
+// as far as every error before them can be reported, so the chain of
+// productions, which changes as the parse goes on, is only copied for those,
+// unless an error policy is given every error.
+func (e *parserErrorStack) push(v *parseError, productions []string) {
+	if e.chains || v.pos >= e.max {
+		v.productions = append([]string(nil), productions...)
+	}
+	if v.pos > e.max {
+		e.max = v.pos
+	}
+	e.stack = append(e.stack, v)
+}
+
+func (e *parserErrorStack) error(err error, pos int, productions []string) {
+	e.push(&parseError{ err: err, pos: pos }, productions)
+}
+
+// reject records err for an action that rejected the input matched since
+// mark. The errors recorded since mark were ones the parser got past, so they
+// are dropped, leaving only the action's error at pos.
+func (e *parserErrorStack) reject(err error, mark int, pos int, productions []string) {
+	if mark < len(e.stack) {
+		e.truncate(e.stack[:mark])
+	}
+	e.error(err, pos, productions)
+}
+
+// expect records err as a failure to match the given literal, lexer, or
+// production.
+func (e *parserErrorStack) expect(err error, pos int, productions []string, expected string) {
+	e.push(&parseError{ err: err, pos: pos, expected: expected }, productions)
+}
+
+// label replaces the expectations on the stack with a single expectation of
+// the innermost production in productions, as long as nothing was recorded
+// past pos. This is used when a production fails without consuming any input,
+// so that the error names the production instead of everything inside of it.
+// The new expectation is recorded against the production's caller.
+func (e *parserErrorStack) label(pos int, productions []string) {
+	if len(productions) == 0 {
+		return
+	}
+	e.relabel(0, pos, productions[:len(productions)-1], productions[len(productions)-1])
+}
+
+// relabel replaces the expectations recorded since mark with a single
+// expectation of label, as long as none of them are past pos.
+func (e *parserErrorStack) relabel(mark int, pos int, productions []string, label string) {
+	for _, v := range e.stack[mark:] {
+		if v.pos > pos {
+			return
+		}
+	}
+
+	stack := e.stack[:mark]
+	for _, v := range e.stack[mark:] {
+		if v.expected == "" {
+			stack = append(stack, v)
+		}
+	}
+	e.truncate(stack)
+	e.push(&parseError{
+		err:      fmt.Errorf("expected %v", label),
+		pos:      pos,
+		expected: label,
+	}, productions)
+}
+
+// farthest returns the errors recorded at the greatest depth, deduplicated and
+// in the order they were recorded.
+func (e *parserErrorStack) farthest() []*parseError {
+	return farthestErrors(e.stack)
+}
+
+// farthestErrors returns the errors in stack recorded at the greatest depth,
+// deduplicated and in the order they were recorded.
+func farthestErrors(stack []*parseError) []*parseError {
+	var bestDepth int
+	var es []*parseError
+
+COALESCE_OUTER:
+	for _, v := range stack {
+		if v.pos > bestDepth {
+			bestDepth = v.pos
+			es = []*parseError{v}
+		} else if v.pos == bestDepth {
+			// deduplicate errors at a given depth
 			for _, w := range es {
-				if w.Error() == v.err.Error() {
+				if w.expected == v.expected && w.err.Error() == v.err.Error() {
 					continue COALESCE_OUTER
 				}
 			}
-			es = append(es, v.err)
+			es = append(es, v)
 		}
 	}
+	return es
+}
+
+func (e *parserErrorStack) coalesce() error {
+	es := e.farthest()
 	
 	if len(es) == 0 {
 		return nil
 	} else if len(es) == 1 {
-		return es[0]
+		return es[0].err
 	} else {
 		// print the error stack in reverse order
 		var ret string
 		for i := len(es)-1; i >= 0; i-- {
-			ret += es[i].Error() + "\n"
+			ret += es[i].err.Error() + "\n"
 		}
 		return errors.New(strings.TrimSpace(ret))
 	}
 }
 
 func (e *parserErrorStack) depth() int {
-	var ret int
-	for _, v := range e.stack {
-		if v.pos > ret {
-			ret = v.pos
+	return e.max
+}
+
+// _PREFIX_ErrorRecord is an error recorded while parsing. Offset is its
+// position in the input, Productions is the chain of productions it was
+// recorded in, outermost first, and Expected is the literal, lexer function,
+// or production that was expected there, if any.
+type _PREFIX_ErrorRecord struct {
+	Err         error
+	Offset      int
+	Productions []string
+	Expected    string
+}
+
+// _PREFIX_ErrorPolicy can be implemented by _PREFIX_Data to choose which of
+// the recorded errors are reported. ErrorPolicy is given every error recorded
+// while parsing the failed production, in the order they were recorded, and
+// returns the errors to report. The first error returned sets the position of
+// the _PREFIX_ParseError. If it returns no errors, the default policy
+// (_PREFIX_FarthestErrors) is used.
+type _PREFIX_ErrorPolicy interface {
+	ErrorPolicy(stack []*_PREFIX_ErrorRecord) []*_PREFIX_ErrorRecord
+}
+
+// _PREFIX_FarthestErrors is the default error policy. It returns the errors
+// in stack recorded at the greatest offset, deduplicated and in the order they
+// were recorded.
+func _PREFIX_FarthestErrors(stack []*_PREFIX_ErrorRecord) []*_PREFIX_ErrorRecord {
+	var es []*parseError
+	for _, v := range stack {
+		es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
+	}
+	return _PREFIX_errorRecords(farthestErrors(es))
+}
+
+// _PREFIX_errorRecords returns the records of the errors in stack.
+func _PREFIX_errorRecords(stack []*parseError) []*_PREFIX_ErrorRecord {
+	var r []*_PREFIX_ErrorRecord
+	for _, v := range stack {
+		r = append(r, &_PREFIX_ErrorRecord{Err: v.err, Offset: v.pos, Productions: v.productions, Expected: v.expected})
+	}
+	return r
+}
+
+// parseError returns the errors chosen by the error policy from the parser's
+// error stack as a _PREFIX_ParseError, or nil if there are none.
+func (p *_PREFIX_Parser) parseError() error {
+	var es []*parseError
+	if policy, ok := interface{}(p.Data).(_PREFIX_ErrorPolicy); ok {
+		for _, v := range policy.ErrorPolicy(_PREFIX_errorRecords(p.errorStack.stack)) {
+			es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
+		}
+	}
+	if len(es) == 0 {
+		es = p.errorStack.farthest()
+	}
+	if len(es) == 0 {
+		return nil
+	}
+
+	line, column := p.position(es[0].pos)
+	ret := &_PREFIX_ParseError{
+		Offset:      es[0].pos,
+		Line:        line,
+		Column:      column,
+		Productions: es[0].productions,
+	}
+	if len(ret.Productions) > 0 {
+		ret.Production = ret.Productions[len(ret.Productions)-1]
+	}
+
+EXPECTED_LOOP:
+	for _, v := range es {
+		ret.Messages = append(ret.Messages, v.err.Error())
+		if v.expected == "" {
+			// errors from Error blocks often wrap the default error,
+			// which already has a position
+			var perr *_PREFIX_ParseError
+			if errors.As(v.err, &perr) {
+				ret.other = append(ret.other, v.err.Error())
+			} else {
+				ret.other = append(ret.other, fmt.Sprintf("%v at %v:%v", v.err, line, column))
+			}
+			continue
 		}
+		for _, w := range ret.Expected {
+			if w == v.expected {
+				continue EXPECTED_LOOP
+			}
+		}
+		ret.Expected = append(ret.Expected, v.expected)
 	}
 	return ret
 }
+
+// recover implements Recover blocks. It skips the input past the first of the
+// sync literals found after the farthest error, and sets the error aside to be
+// returned by Parse_PREFIX_. It returns false if none of the sync literals are
+// found.
+func (p *_PREFIX_Parser) recover(sync ...string) bool {
+	if !p.sync(sync...) {
+		return false
+	}
+	if err := p.parseError(); err != nil {
+		p.recovered = append(p.recovered, err)
+	}
+	p.errorStack.clear()
+	return true
+}
+
+// recoveredErrors returns err along with any errors set aside by Recover
+// blocks. If there is more than one error, they are returned as a
+// _PREFIX_ParseErrors.
+func (p *_PREFIX_Parser) recoveredErrors(err error) error {
+	if len(p.recovered) == 0 {
+		return err
+	}
+
+	errs := p.recovered
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return _PREFIX_ParseErrors(errs)
+}
+
+// errorPos returns the position of a failed term. Literals and lexer functions
+// report failures past the current position by returning a _PREFIX_LexError.
+func (p *_PREFIX_Parser) errorPos(err error) int {
+	var lerr *_PREFIX_LexError
+	if errors.As(err, &lerr) {
+		return p.clamp(p.pos + lerr.Offset)
+	}
+	return p.pos
+}
+
+// trailingError returns the error for input left over after a successful
+// parse of the entrypoint.
+func (p *_PREFIX_Parser) trailingError() error {
+	pos := p.skipSpace(p.pos)
+	if len(p.errorStack.stack) == 0 || p.errorStack.depth() < pos {
+		p.errorStack.error(errors.New("unexpected input"), pos, p.productions)
+	}
+	return p.parseError()
+}
 `
 
 var header = `
 
 func Parse_PREFIX_(input string, data *_PREFIX_Data) %v {
 	p := new_PREFIX_Parser(input, data)
+	defer p.diagnose(&err)
 
-	%v := p.state_ENTRYPOINT_()
+	%v = p.state_ENTRYPOINT_()
 	if err == nil {
 		if strings.TrimSpace(p.input[p.pos:]) != "" {
-			err = p.errorStack.coalesce()
-			%v
+			err = p.trailingError()
 		}
 	} else {
-		err = p.errorStack.coalesce()
+		err = p.parseError()
 	}
-	
-	%v 
+	err = p.recoveredErrors(err)
+
+	%v
 }
 
 type _PREFIX_Parser struct {
@@ -640,17 +1854,30 @@ type _PREFIX_Parser struct {
 	lineOffsets []int
 	Data        *_PREFIX_Data
 	errorStack  *parserErrorStack
+	productions []string // the productions currently being parsed, outermost first
+	recovered   []error  // errors set aside by Recover blocks
+	deferred    []func() // actions waiting for the current prediction to be accepted, with -defer
+	undo        []func() // functions given to Undo by actions in the current prediction
+	memo        map[_PREFIX_memoKey]*_PREFIX_memoEntry // remembered results of productions, by position
 
 	predictStack []*_PREFIX_Parser
 }
 
 func new_PREFIX_Parser(input string, data *_PREFIX_Data) *_PREFIX_Parser {
-	return &_PREFIX_Parser{
+	p := &_PREFIX_Parser{
 		input:       input,
 		lineOffsets: _PREFIX_GenerateLineOffsets(input),
 		Data: data,
 		errorStack: &parserErrorStack{},
+		memo: make(map[_PREFIX_memoKey]*_PREFIX_memoEntry),
+	}
+	if _, ok := interface{}(data).(_PREFIX_ErrorPolicy); ok {
+		p.errorStack.chains = true
 	}
+	if d := p.diagnostics(); d != nil {
+		d.warnings = nil
+	}
+	return p
 }
 
 func _PREFIX_GenerateLineOffsets(input string) []int {
@@ -666,20 +1893,201 @@ func _PREFIX_GenerateLineOffsets(input string) []int {
 	return ret
 }
 
+// position returns the 1-based line and column of the byte offset pos.
+func (p *_PREFIX_Parser) position(pos int) (int, int) {
+	return _PREFIX_Context{input: p.input, lineOffsets: p.lineOffsets}.position(pos)
+}
+
+// _PREFIX_Context describes the input matched by a production, and is given
+// to the production's action.
+type _PREFIX_Context struct {
+	Start      int    // byte offset of the match, after any leading whitespace
+	End        int    // byte offset just past the match
+	Production string // name of the matched production
+
+	input       string
+	lineOffsets []int
+	parser      *_PREFIX_Parser
+}
+
+// context returns the context of production, which was entered at pos and
+// matched up to the current position.
+func (p *_PREFIX_Parser) context(pos int, production string) _PREFIX_Context {
+	start := p.skipSpace(pos)
+	if start > p.pos {
+		start = p.pos
+	}
+	return _PREFIX_Context{
+		Start:       start,
+		End:         p.pos,
+		Production:  production,
+		input:       p.input,
+		lineOffsets: p.lineOffsets,
+		parser:      p,
+	}
+}
+
+// Text returns the matched input.
+func (c _PREFIX_Context) Text() string {
+	return c.input[c.Start:c.End]
+}
+
+// Undo registers f to be called if the parser backtracks over the matched
+// input, so that an action can reverse its side effects on the data object.
+// Functions are called most recent first. Undo has no effect once the input
+// can no longer be backtracked, including in actions deferred with -defer.
+func (c _PREFIX_Context) Undo(f func()) {
+	if c.parser != nil {
+		c.parser.onUndo(f)
+	}
+}
+
+// Line returns the 1-based line the match starts on.
+func (c _PREFIX_Context) Line() int {
+	line, _ := c.position(c.Start)
+	return line
+}
+
+// Column returns the 1-based column, in runes, the match starts at.
+func (c _PREFIX_Context) Column() int {
+	_, column := c.position(c.Start)
+	return column
+}
+
+func (c _PREFIX_Context) position(pos int) (int, int) {
+	lo, hi := 0, len(c.lineOffsets)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if c.lineOffsets[mid] <= pos {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	start := 0
+	if lo > 0 {
+		start = c.lineOffsets[lo-1]
+	}
+	return lo + 1, utf8.RuneCountInString(c.input[start:pos]) + 1
+}
+
+// Pretty returns the error message followed by the line of input containing
+// the error, with a caret under the failing column.
+func (e *_PREFIX_ParseError) Pretty(input string) string {
+	offsets := _PREFIX_GenerateLineOffsets(input)
+	if e.Line < 1 || e.Line > len(offsets) {
+		return e.Error()
+	}
+
+	start := 0
+	if e.Line > 1 {
+		start = offsets[e.Line-2]
+	}
+	end := offsets[e.Line-1] - 1
+	if end > len(input) {
+		end = len(input)
+	}
+	line := strings.TrimSuffix(input[start:end], "\r")
+
+	// keep tabs in the padding so the caret lines up with the input
+	var pad strings.Builder
+	column := 1
+	for _, r := range line {
+		if column >= e.Column {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+		column++
+	}
+
+	return e.Error() + "\n" + line + "\n" + pad.String() + "^"
+}
+
+// sync skips the input past the first of the sync literals found after the
+// farthest error on the error stack. Quoted strings and blocks in braces, such
+// as code, are skipped whole, so a sync literal inside of them is not matched.
+// It returns false, leaving the position unchanged, if none of the sync
+// literals are found.
+func (p *_PREFIX_Parser) sync(sync ...string) bool {
+	pos := p.errorStack.depth()
+	if pos < p.pos {
+		pos = p.pos
+	}
+
+	var depth int
+	for i := pos; i < len(p.input); i++ {
+		if depth == 0 {
+			for _, v := range sync {
+				if v != "" && strings.HasPrefix(p.input[i:], v) {
+					p.pos = i + len(v)
+					return true
+				}
+			}
+		}
+		switch p.input[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '"', '\x60':
+			i = p.skipQuoted(i)
+		case '\'':
+			// outside of braces, a single quote is more likely an
+			// apostrophe than the start of a character literal.
+			if depth > 0 {
+				i = p.skipQuoted(i)
+			}
+		}
+	}
+	return false
+}
+
+// skipQuoted returns the position of the quote closing the string that starts
+// at pos. Strings in double or single quotes can contain escaped quotes, and
+// end at the end of the line if they are not closed. Strings in back quotes
+// end at the end of the input.
+func (p *_PREFIX_Parser) skipQuoted(pos int) int {
+	q := p.input[pos]
+	for i := pos + 1; i < len(p.input); i++ {
+		switch c := p.input[i]; {
+		case c == q:
+			return i
+		case c == '\\' && q != '\x60':
+			i++
+		case c == '\n' && q != '\x60':
+			return i
+		}
+	}
+	return len(p.input)
+}
+
+// skipSpace returns the position of the first non-whitespace character at or
+// after pos.
+func (p *_PREFIX_Parser) skipSpace(pos int) int {
+	for r, s := utf8.DecodeRuneInString(p.input[pos:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[pos:]) {
+		pos += s
+	}
+	return pos
+}
+
 func (p *_PREFIX_Parser) literal(want string) (string, error) {
 	var errExpected = fmt.Errorf("expected %%v", want)
 
-	count := 0
-	for r, s := utf8.DecodeRuneInString(p.input[p.pos+count:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[p.pos+count:]) {
-		count += s
-	}
+	count := p.skipSpace(p.pos) - p.pos
 
 	if strings.HasPrefix(p.input[p.pos+count:], want) {
 		p.pos += count + len(want)
 		return want, nil
 	}
 
-	return "", errExpected
+	return "", &_PREFIX_LexError{Offset: count, Err: errExpected}
 }
 
 func (p *_PREFIX_Parser) predict() *_PREFIX_Parser {
@@ -690,39 +2098,102 @@ func (p *_PREFIX_Parser) predict() *_PREFIX_Parser {
 		lineOffsets: p.lineOffsets,
 		predictStack: p.predictStack,
 		errorStack: p.errorStack,
+		productions: p.productions,
+		recovered: p.recovered,
+		deferred: p.deferred,
+		undo: p.undo,
+		memo: p.memo,
 		Data: p.Data,
 	}
 }
 
+// backtrack abandons the current prediction, calling the functions given to
+// Undo since it began, most recent first.
 func (p *_PREFIX_Parser) backtrack() *_PREFIX_Parser {
+	pp := p.pop()
+	for i := len(p.undo) - 1; i >= len(pp.undo); i-- {
+		p.undo[i]()
+	}
+	return pp
+}
+
+// pop returns the parser the current prediction began from, with the errors
+// recorded since.
+func (p *_PREFIX_Parser) pop() *_PREFIX_Parser {
 	pp := p.predictStack[len(p.predictStack)-1]
 	pp.predictStack = pp.predictStack[:len(pp.predictStack)-1]
 	pp.errorStack = p.errorStack
 	return pp
 }
 
+// keep returns the parser the current prediction began from, like backtrack,
+// but without undoing the actions run since, whose results are kept.
+func (p *_PREFIX_Parser) keep() *_PREFIX_Parser {
+	pp := p.pop()
+	if len(pp.predictStack) > 0 {
+		pp.undo = p.undo
+	}
+	return pp
+}
+
 func (p *_PREFIX_Parser) accept() *_PREFIX_Parser {
-	pp := p.backtrack()
+	pp := p.pop()
 	pp.pos = p.pos
+	pp.recovered = p.recovered
+	pp.deferred = p.deferred
+	pp.undo = p.undo
+	if len(pp.predictStack) == 0 {
+		pp.undo = nil
+		pp.runDeferred()
+	}
 	return pp
 }
+
+// onUndo holds f until the outermost prediction is accepted, calling it if
+// the prediction is backtracked instead. Outside of a prediction, the input
+// can't be backtracked, so f is dropped.
+func (p *_PREFIX_Parser) onUndo(f func()) {
+	if len(p.predictStack) > 0 {
+		p.undo = append(p.undo, f)
+	}
+}
+
+// queue runs f now if the parser is not inside of a prediction, and otherwise
+// holds it until the outermost prediction is accepted. If the prediction is
+// backtracked instead, f is discarded.
+func (p *_PREFIX_Parser) queue(f func()) {
+	if len(p.predictStack) == 0 {
+		f()
+		return
+	}
+	p.deferred = append(p.deferred, f)
+}
+
+func (p *_PREFIX_Parser) runDeferred() {
+	deferred := p.deferred
+	p.deferred = nil
+	for _, f := range deferred {
+		f()
+	}
+}
 `
 
 var headerTokenMode = `
 func Parse_PREFIX_(input []string, data *_PREFIX_Data) %v {
 	p := new_PREFIX_Parser(input, data)
+	defer p.diagnose(&err)
 
-	%v := p.state_ENTRYPOINT_()
+	%v = p.state_ENTRYPOINT_()
 	if err == nil {
 		if p.pos < len(p.input) {
-			err = p.errorStack.coalesce()
-			%v
+			err = p.trailingError()
 		}
 	} else {
-		err = p.errorStack.coalesce()
+		err = p.parseError()
 	}
-	
-	%v 
+	err = p.recoveredErrors(err)
+
+	%v
 }
 
 type _PREFIX_Parser struct {
@@ -730,16 +2201,118 @@ type _PREFIX_Parser struct {
 	pos         int
 	Data        *_PREFIX_Data
 	errorStack  *parserErrorStack
+	productions []string // the productions currently being parsed, outermost first
+	recovered   []error  // errors set aside by Recover blocks
+	deferred    []func() // actions waiting for the current prediction to be accepted, with -defer
+	undo        []func() // functions given to Undo by actions in the current prediction
+	memo        map[_PREFIX_memoKey]*_PREFIX_memoEntry // remembered results of productions, by position
 
 	predictStack []*_PREFIX_Parser
 }
 
 func new_PREFIX_Parser(input []string, data *_PREFIX_Data) *_PREFIX_Parser {
-	return &_PREFIX_Parser{
+	p := &_PREFIX_Parser{
 		input:       input,
 		Data: data,
 		errorStack: &parserErrorStack{},
+		memo: make(map[_PREFIX_memoKey]*_PREFIX_memoEntry),
+	}
+	if _, ok := interface{}(data).(_PREFIX_ErrorPolicy); ok {
+		p.errorStack.chains = true
+	}
+	if d := p.diagnostics(); d != nil {
+		d.warnings = nil
+	}
+	return p
+}
+
+// position returns the line and column of the token at pos. Tokens have no
+// lines, so the line is always 1 and the column is the token number.
+func (p *_PREFIX_Parser) position(pos int) (int, int) {
+	return 1, pos + 1
+}
+
+// _PREFIX_Context describes the tokens matched by a production, and is given
+// to the production's action.
+type _PREFIX_Context struct {
+	Start      int    // index of the first matched token
+	End        int    // index just past the last matched token
+	Production string // name of the matched production
+
+	input  []string
+	parser *_PREFIX_Parser
+}
+
+// context returns the context of production, which was entered at pos and
+// matched up to the current position.
+func (p *_PREFIX_Parser) context(pos int, production string) _PREFIX_Context {
+	return _PREFIX_Context{
+		Start:      pos,
+		End:        p.pos,
+		Production: production,
+		input:      p.input,
+		parser:     p,
+	}
+}
+
+// Text returns the matched tokens separated by spaces.
+func (c _PREFIX_Context) Text() string {
+	return strings.Join(c.input[c.Start:c.End], " ")
+}
+
+// Undo registers f to be called if the parser backtracks over the matched
+// input, so that an action can reverse its side effects on the data object.
+// Functions are called most recent first. Undo has no effect once the input
+// can no longer be backtracked, including in actions deferred with -defer.
+func (c _PREFIX_Context) Undo(f func()) {
+	if c.parser != nil {
+		c.parser.onUndo(f)
+	}
+}
+
+// Line returns 1, as tokens have no lines.
+func (c _PREFIX_Context) Line() int {
+	return 1
+}
+
+// Column returns the 1-based number of the first matched token.
+func (c _PREFIX_Context) Column() int {
+	return c.Start + 1
+}
+
+// Pretty returns the error message followed by the input tokens separated by
+// spaces, with a caret under the failing token.
+func (e *_PREFIX_ParseError) Pretty(input []string) string {
+	var pad int
+	for i := 0; i < e.Column-1 && i < len(input); i++ {
+		pad += utf8.RuneCountInString(input[i]) + 1
 	}
+	return e.Error() + "\n" + strings.Join(input, " ") + "\n" + strings.Repeat(" ", pad) + "^"
+}
+
+// sync skips the input past the first of the sync literals found after the
+// farthest error on the error stack. It returns false, leaving the position
+// unchanged, if none of the sync literals are found.
+func (p *_PREFIX_Parser) sync(sync ...string) bool {
+	pos := p.errorStack.depth()
+	if pos < p.pos {
+		pos = p.pos
+	}
+
+	for i := pos; i < len(p.input); i++ {
+		for _, v := range sync {
+			if p.input[i] == v {
+				p.pos = i + 1
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// skipSpace returns pos, as tokens do not contain whitespace.
+func (p *_PREFIX_Parser) skipSpace(pos int) int {
+	return pos
 }
 
 func (p *_PREFIX_Parser) literal(want string) (string, error) {
@@ -763,22 +2336,128 @@ func (p *_PREFIX_Parser) predict() *_PREFIX_Parser {
 		pos: p.pos,
 		predictStack: p.predictStack,
 		errorStack: p.errorStack,
+		productions: p.productions,
+		recovered: p.recovered,
+		deferred: p.deferred,
+		undo: p.undo,
+		memo: p.memo,
 		Data: p.Data,
 	}
 }
 
+// backtrack abandons the current prediction, calling the functions given to
+// Undo since it began, most recent first.
 func (p *_PREFIX_Parser) backtrack() *_PREFIX_Parser {
+	pp := p.pop()
+	for i := len(p.undo) - 1; i >= len(pp.undo); i-- {
+		p.undo[i]()
+	}
+	return pp
+}
+
+// pop returns the parser the current prediction began from, with the errors
+// recorded since.
+func (p *_PREFIX_Parser) pop() *_PREFIX_Parser {
 	pp := p.predictStack[len(p.predictStack)-1]
 	pp.predictStack = pp.predictStack[:len(pp.predictStack)-1]
 	pp.errorStack = p.errorStack
 	return pp
 }
 
+// keep returns the parser the current prediction began from, like backtrack,
+// but without undoing the actions run since, whose results are kept.
+func (p *_PREFIX_Parser) keep() *_PREFIX_Parser {
+	pp := p.pop()
+	if len(pp.predictStack) > 0 {
+		pp.undo = p.undo
+	}
+	return pp
+}
+
 func (p *_PREFIX_Parser) accept() *_PREFIX_Parser {
-	pp := p.backtrack()
+	pp := p.pop()
 	pp.pos = p.pos
+	pp.recovered = p.recovered
+	pp.deferred = p.deferred
+	pp.undo = p.undo
+	if len(pp.predictStack) == 0 {
+		pp.undo = nil
+		pp.runDeferred()
+	}
 	return pp
 }
+
+// onUndo holds f until the outermost prediction is accepted, calling it if
+// the prediction is backtracked instead. Outside of a prediction, the input
+// can't be backtracked, so f is dropped.
+func (p *_PREFIX_Parser) onUndo(f func()) {
+	if len(p.predictStack) > 0 {
+		p.undo = append(p.undo, f)
+	}
+}
+
+// queue runs f now if the parser is not inside of a prediction, and otherwise
+// holds it until the outermost prediction is accepted. If the prediction is
+// backtracked instead, f is discarded.
+func (p *_PREFIX_Parser) queue(f func()) {
+	if len(p.predictStack) == 0 {
+		f()
+		return
+	}
+	p.deferred = append(p.deferred, f)
+}
+
+func (p *_PREFIX_Parser) runDeferred() {
+	deferred := p.deferred
+	p.deferred = nil
+	for _, f := range deferred {
+		f()
+	}
+}
+`
+
+// memoization is the runtime code shared by both modes for remembering the
+// results of productions.
+var memoization = `
+// _PREFIX_memoKey identifies the result of a production at a position.
+type _PREFIX_memoKey struct {
+	id  int
+	pos int
+}
+
+// _PREFIX_memoEntry is a remembered result of a production: its value, the
+// position just past the input it matched, its error, and the errors,
+// deferred actions, and recovered errors it left behind.
+type _PREFIX_memoEntry struct {
+	value     interface{}
+	end       int
+	err       error
+	errors    *parserErrorStack
+	deferred  []func()
+	recovered []error
+}
+
+// _PREFIX_errLeftRecursion fails a left recursive production that calls
+// itself before it has matched anything at a position.
+var _PREFIX_errLeftRecursion = errors.New("left recursion")
+
+// recall moves the parser past the input matched by a remembered result,
+// records its errors again, and queues its deferred actions again, returning
+// its error.
+func (p *_PREFIX_Parser) recall(m *_PREFIX_memoEntry) error {
+	if m.errors != nil {
+		p.errorStack.merge(m.errors)
+	}
+	p.pos = m.end
+	if m.err != nil {
+		return m.err
+	}
+	p.recovered = append(p.recovered, m.recovered...)
+	for _, f := range m.deferred {
+		p.queue(f)
+	}
+	return nil
+}
 `
 
 var doNotModify = `// generated by pbpg, do not modify
@@ -0,0 +1,333 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// END is the token following the entrypoint, at the end of the input.
+const END = "$"
+
+// A tokenSet is a set of the literals and lexer functions that can start or
+// follow part of the grammar. Literals are quoted, and lexer functions are
+// written as lex(name). Each literal and lexer function is a distinct token,
+// though lexer functions may match input that other tokens also match.
+type tokenSet map[string]bool
+
+// add adds the tokens in s to the set, and returns true if any were new.
+func (t tokenSet) add(s tokenSet) bool {
+	var changed bool
+	for k := range s {
+		if !t[k] {
+			t[k] = true
+			changed = true
+		}
+	}
+	return changed
+}
+
+func (t tokenSet) union(s tokenSet) tokenSet {
+	r := tokenSet{}
+	r.add(t)
+	r.add(s)
+	return r
+}
+
+func (t tokenSet) intersect(s tokenSet) tokenSet {
+	r := tokenSet{}
+	for k := range t {
+		if s[k] {
+			r[k] = true
+		}
+	}
+	return r
+}
+
+func (t tokenSet) String() string {
+	var r []string
+	for k := range t {
+		r = append(r, k)
+	}
+	sort.Strings(r)
+	return strings.Join(r, ", ")
+}
+
+// A firstFollow holds the FIRST and FOLLOW sets of a grammar: the tokens each
+// production can start with, and the tokens that can come after it. The
+// tokens that can come after each expression, and after each group, option,
+// and repetition, are kept to find conflicts.
+type firstFollow struct {
+	nullable map[string]bool
+	first    map[string]tokenSet
+	follow   map[string]tokenSet
+	after    map[*Expression]tokenSet
+	afterGOR map[*Term]tokenSet
+}
+
+// firstFollow computes the FIRST and FOLLOW sets of the grammar.
+func (p *pbpgData) firstFollow() *firstFollow {
+	ff := &firstFollow{
+		nullable: p.nullable(),
+		first:    make(map[string]tokenSet),
+		follow:   make(map[string]tokenSet),
+		after:    make(map[*Expression]tokenSet),
+		afterGOR: make(map[*Term]tokenSet),
+	}
+	for _, k := range p.orderedStates {
+		ff.first[k] = tokenSet{}
+		ff.follow[k] = tokenSet{}
+	}
+
+	for changed := true; changed; {
+		changed = false
+		for _, k := range p.orderedStates {
+			if ff.first[k].add(ff.firstOf(p.stateMap[k])) {
+				changed = true
+			}
+		}
+	}
+
+	ff.follow[p.entryPoint][END] = true
+	for changed := true; changed; {
+		changed = false
+		for _, k := range p.orderedStates {
+			if ff.followExpression(p.stateMap[k], ff.follow[k].union(p.operators(k))) {
+				changed = true
+			}
+		}
+	}
+	return ff
+}
+
+// operators returns the operators of the precedence table of a production,
+// which can follow each of its operands.
+func (p *pbpgData) operators(k string) tokenSet {
+	r := tokenSet{}
+	for _, v := range p.lines {
+		if v.production == nil || v.production.name != k {
+			continue
+		}
+		for _, l := range v.production.precedence {
+			for _, op := range l.operators {
+				r[strconv.Quote(op)] = true
+			}
+		}
+	}
+	return r
+}
+
+func (ff *firstFollow) firstOf(e *Expression) tokenSet {
+	r := tokenSet{}
+	for _, a := range e.alternatives {
+		r.add(ff.firstOfTerms(a.terms))
+	}
+	return r
+}
+
+// firstOfTerms returns the tokens a sequence of terms can start with.
+func (ff *firstFollow) firstOfTerms(terms []*Term) tokenSet {
+	r := tokenSet{}
+	for _, t := range terms {
+		switch t.option {
+		case TERM_NAME:
+			r.add(ff.first[t.state()])
+		case TERM_LITERAL:
+			if t.literal != "" {
+				r[strconv.Quote(t.literal)] = true
+			}
+		case TERM_LEX:
+			r["lex("+t.lex+")"] = true
+		case TERM_GOR:
+			r.add(ff.firstOf(t.gor.expression))
+		}
+		if !t.nullable(ff.nullable) {
+			break
+		}
+	}
+	return r
+}
+
+// followExpression adds the tokens that can follow each production used in
+// the expression, given the tokens that can follow the expression itself, and
+// returns true if any were new.
+func (ff *firstFollow) followExpression(e *Expression, follow tokenSet) bool {
+	if ff.after[e] == nil {
+		ff.after[e] = tokenSet{}
+	}
+	changed := ff.after[e].add(follow)
+
+	for _, a := range e.alternatives {
+		// walk the terms backwards, keeping the tokens that can follow
+		// the current one.
+		trailer := follow
+		for i := len(a.terms) - 1; i >= 0; i-- {
+			t := a.terms[i]
+			switch t.option {
+			case TERM_NAME:
+				if ff.follow[t.state()].add(trailer) {
+					changed = true
+				}
+			case TERM_GOR:
+				if ff.afterGOR[t] == nil {
+					ff.afterGOR[t] = tokenSet{}
+				}
+				ff.afterGOR[t].add(trailer)
+				inner := trailer
+				if t.gor.option == GOR_REPETITION {
+					inner = trailer.union(ff.firstOf(t.gor.expression))
+				}
+				if ff.followExpression(t.gor.expression, inner) {
+					changed = true
+				}
+			}
+			if t.nullable(ff.nullable) {
+				trailer = trailer.union(ff.firstOfTerms(a.terms[i : i+1]))
+			} else {
+				trailer = ff.firstOfTerms(a.terms[i : i+1])
+			}
+		}
+	}
+	return changed
+}
+
+// conflicts returns the places in the expression where the next token doesn't
+// decide what to parse, so the parser may need to backtrack: alternatives that
+// can start with the same token, more than one alternative that can match
+// without consuming input, an alternative that can match without consuming
+// input and start with a token that can follow the expression, and options
+// and repetitions that can start with a token that can follow them.
+func (ff *firstFollow) conflicts(e *Expression) []string {
+	var r []string
+	var nullable []*Alternative
+	for i, a := range e.alternatives {
+		for _, b := range e.alternatives[:i] {
+			if s := ff.firstOfTerms(a.terms).intersect(ff.firstOfTerms(b.terms)); len(s) > 0 {
+				r = append(r, fmt.Sprintf("alternatives %v and %v can both start with %v", b, a, s))
+			}
+		}
+		if a.nullable(ff.nullable) {
+			nullable = append(nullable, a)
+		}
+	}
+	for _, a := range nullable {
+		for _, b := range e.alternatives {
+			if b == a {
+				continue
+			}
+			if s := ff.firstOfTerms(b.terms).intersect(ff.after[e]); len(s) > 0 {
+				r = append(r, fmt.Sprintf("alternative %v can match without consuming input, and %v can start with %v, which can also follow them", a, b, s))
+			}
+		}
+	}
+	if len(nullable) > 1 {
+		r = append(r, fmt.Sprintf("alternatives %v and %v can both match without consuming input", nullable[0], nullable[1]))
+	}
+
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if t.option != TERM_GOR {
+				continue
+			}
+			if t.gor.option != GOR_GROUP {
+				if s := ff.firstOf(t.gor.expression).intersect(ff.afterGOR[t]); len(s) > 0 {
+					r = append(r, fmt.Sprintf("%v can start with %v, which can also follow it", t.gor, s))
+				}
+			}
+			r = append(r, ff.conflicts(t.gor.expression)...)
+		}
+	}
+	return r
+}
+
+// Analyze returns a report of the FIRST and FOLLOW sets of each production,
+// the conflicts that keep a production from being parsed by looking at the
+// next token alone, and which productions are LL(1), with no conflicts.
+// Productions that are LL(1) never backtrack further than a single token. The
+// report ends with the estimated cost class of each production, and
+// suggestions for left factoring alternatives that share their leading terms.
+func (p *pbpgData) Analyze() string {
+	ff := p.firstFollow()
+
+	titles := make(map[string]string)
+	for _, v := range p.instances {
+		for _, inst := range v {
+			titles[inst.name] = inst.call
+		}
+	}
+	title := func(k string) string {
+		if t, ok := titles[k]; ok {
+			return t
+		}
+		return k
+	}
+
+	var s strings.Builder
+	w := tabwriter.NewWriter(&s, 0, 0, 1, ' ', 0)
+	w.Write([]byte("Production\tFIRST\tFOLLOW\n"))
+	for _, k := range p.orderedStates {
+		first := ff.first[k].String()
+		if ff.nullable[k] {
+			first = strings.TrimPrefix(first+", (empty)", ", ")
+		}
+		w.Write([]byte(fmt.Sprintf("%v\t%v\t%v\n", title(k), first, ff.follow[k])))
+	}
+	w.Flush()
+
+	var ll1, other []string
+	s.WriteString("\nConflicts:\n")
+	for _, k := range p.orderedStates {
+		c := ff.conflicts(p.stateMap[k])
+		if p.leaders[k] {
+			c = append(c, "left recursive, so its result is grown from a seed")
+		}
+		if len(c) == 0 {
+			ll1 = append(ll1, title(k))
+			continue
+		}
+		other = append(other, title(k))
+		for _, v := range c {
+			s.WriteString(fmt.Sprintf("  %v: %v\n", title(k), v))
+		}
+	}
+	if len(other) == 0 {
+		s.WriteString("  none\n")
+	}
+
+	s.WriteString(fmt.Sprintf("\nLL(1): %v of %v productions\n", len(ll1), len(p.orderedStates)))
+	if len(ll1) > 0 {
+		s.WriteString(fmt.Sprintf("  LL(1): %v\n", strings.Join(ll1, ", ")))
+	}
+	if len(other) > 0 {
+		s.WriteString(fmt.Sprintf("  may backtrack: %v\n", strings.Join(other, ", ")))
+	}
+
+	s.WriteString("\nCost:\n")
+	costs := p.costs(ff)
+	w = tabwriter.NewWriter(&s, 0, 0, 1, ' ', 0)
+	for _, k := range p.orderedStates {
+		w.Write([]byte(fmt.Sprintf("  %v\t%v\n", title(k), costs[k])))
+	}
+	w.Flush()
+
+	var suggestions []string
+	for _, k := range p.orderedStates {
+		for _, v := range leftFactor(p.stateMap[k]) {
+			suggestions = append(suggestions, fmt.Sprintf("  %v: %v\n", title(k), v))
+		}
+	}
+	if len(suggestions) > 0 {
+		s.WriteString("\nSuggestions:\n")
+		s.WriteString(strings.Join(suggestions, ""))
+	}
+	return s.String()
+}
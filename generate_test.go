@@ -0,0 +1,1106 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testHeader is the Go code block of the test grammars. Parsers print the
+// value of the entrypoint, which must have type string, or the error, for
+// each input given as an argument, one per line. If TData has a report
+// method, it is given the input, what would be printed, and the error, and
+// what it returns is printed instead, so that tests can add details of the
+// error or what the data object collected. In token mode, each input is split into
+// tokens at whitespace. %DATA% is replaced by declarations for the grammar,
+// which must include TData, and %INPUT% by the input given to ParseT.
+const testHeader = `{
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+func main() {
+	for _, in := range os.Args[1:] {
+		d := &TData{}
+		v, err := ParseT(%INPUT%, d)
+		out := fmt.Sprint(v)
+		if err != nil {
+			out = err.Error()
+		}
+		if r, ok := interface{}(d).(interface{ report(string, string, error) string }); ok {
+			out = r.report(in, out, err)
+		}
+		fmt.Println(strings.ReplaceAll(out, "\n", "; "))
+	}
+}
+
+// lexNum matches a run of digits after any leading whitespace.
+func lexNum(input string) (int, string, error) {
+	s := strings.TrimLeftFunc(input, unicode.IsSpace)
+	n := len(input) - len(s)
+	var i int
+	for i < len(s) && unicode.IsDigit(rune(s[i])) {
+		i++
+	}
+	if i == 0 {
+		return 0, "", errors.New("expected number")
+	}
+	return n + i, s[:i], nil
+}
+
+var _ = utf8.RuneLen
+
+%DATA%
+}
+`
+
+var (
+	generatorOnce sync.Once
+	generatorPath string
+	generatorErr  error
+)
+
+// generator builds pbpg once for all tests, and returns the path to it.
+func generator(t *testing.T) string {
+	t.Helper()
+	generatorOnce.Do(func() {
+		dir, err := os.MkdirTemp("", "pbpg")
+		if err != nil {
+			generatorErr = err
+			return
+		}
+		generatorPath = filepath.Join(dir, "pbpg")
+		out, err := exec.Command("go", "build", "-o", generatorPath, ".").CombinedOutput()
+		if err != nil {
+			generatorErr = &buildError{err, out}
+		}
+	})
+	if generatorErr != nil {
+		t.Fatal(generatorErr)
+	}
+	return generatorPath
+}
+
+type buildError struct {
+	err error
+	out []byte
+}
+
+func (e *buildError) Error() string {
+	return e.err.Error() + ": " + string(e.out)
+}
+
+// generate runs pbpg with the given flags on the grammar, made of the test
+// header with data, followed by rules. It returns the directory of the
+// generated parser, and what pbpg wrote to stderr.
+func generate(t *testing.T, data, rules string, flags ...string) (string, string, error) {
+	t.Helper()
+	dir := t.TempDir()
+	input := "in"
+	for _, v := range flags {
+		if v == "-token" {
+			input = "strings.Fields(in)"
+		}
+	}
+	grammar := strings.NewReplacer("%DATA%", data, "%INPUT%", input).Replace(testHeader) + rules
+	if err := os.WriteFile(filepath.Join(dir, "g.b"), []byte(grammar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "go.mod"), []byte("module t\n\ngo 1.18\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(generator(t), append(append([]string{"-prefix", "T"}, flags...), "g.b")...)
+	cmd.Dir = dir
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return dir, stderr.String(), err
+}
+
+// parse generates a parser from the grammar with the given flags, and returns
+// its output for each of the inputs.
+func parse(t *testing.T, data, rules string, flags []string, inputs ...string) []string {
+	t.Helper()
+	dir, stderr, err := generate(t, data, rules, flags...)
+	if err != nil {
+		t.Fatalf("pbpg %v: %v: %v", flags, err, stderr)
+	}
+
+	build := exec.Command("go", "build", "-o", "parser", ".")
+	build.Dir = dir
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("building parser: %v: %s", err, out)
+	}
+	out, err := exec.Command(filepath.Join(dir, "parser"), inputs...).Output()
+	if err != nil {
+		t.Fatalf("running parser: %v", err)
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+}
+
+type parseTest struct {
+	input string
+	want  string
+}
+
+// checkParse generates the grammar with each set of flags, and checks the
+// output for each input.
+func checkParse(t *testing.T, data, rules string, tests []parseTest, flagSets ...[]string) {
+	t.Helper()
+	var inputs []string
+	for _, v := range tests {
+		inputs = append(inputs, v.input)
+	}
+	if len(flagSets) == 0 {
+		flagSets = [][]string{nil}
+	}
+	for _, flags := range flagSets {
+		got := parse(t, data, rules, flags, inputs...)
+		if len(got) != len(tests) {
+			t.Fatalf("flags %v: got %v lines of output, want %v: %q", flags, len(got), len(tests), got)
+		}
+		for i, v := range tests {
+			if got[i] != v.want {
+				t.Errorf("flags %v: %q: got %q, want %q", flags, v.input, got[i], v.want)
+			}
+		}
+	}
+}
+
+func TestLeftRecursion(t *testing.T) {
+	data := `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`
+
+	t.Run("direct", func(t *testing.T) {
+		rules := `
+type E string
+E = E "-" lex(Num)	=> { return "(" + v1 + "-" + v3 + ")" }
+  | lex(Num)		=> { return v1 } .
+`
+		checkParse(t, data, rules, []parseTest{
+			{"1", "1"},
+			{"1-2", "(1-2)"},
+			{"1-2-3", "((1-2)-3)"},
+			{"1-", "expected Num at 1:3"},
+		}, nil, []string{"-defer"}, []string{"-memo"})
+	})
+
+	t.Run("indirect", func(t *testing.T) {
+		rules := `
+type A string
+type B string
+A = B "x"	=> { return "(" + v1 + "x)" }
+  | "a"		=> { return v1 } .
+B = A "y"	=> { return "(" + v1 + "y)" }
+  | "b"		=> { return v1 } .
+`
+		checkParse(t, data, rules, []parseTest{
+			{"a", "a"},
+			{"ayx", "((ay)x)"},
+			{"bx", "(bx)"},
+			{"bxyx", "(((bx)y)x)"},
+			{"ay", "expected \"x\" at 1:3"},
+		}, nil, []string{"-defer"}, []string{"-memo"}, []string{"-memo", "-defer"})
+	})
+}
+
+func TestPrecedence(t *testing.T) {
+	data := `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`
+	rules := `
+type Expression string
+type Operand string
+Expression = Operand .
+	%left "+" "-"
+	%left "*" "/"
+	%right "^"		Action { return "(" + lhs + op + rhs + ")" }
+Operand = lex(Num)		=> { return v1 }
+	| "(" Expression ")"	=> { return v2 } .
+`
+	checkParse(t, data, rules, []parseTest{
+		{"1", "1"},
+		{"1-2-3", "((1-2)-3)"},
+		{"1+2*3", "(1+(2*3))"},
+		{"1*2+3", "((1*2)+3)"},
+		{"2^3^2", "(2^(3^2))"},
+		{"2*3^2", "(2*(3^2))"},
+		{"(1+2)*3", "((1+2)*3)"},
+		{"1+", "expected Operand at 1:3"},
+	})
+}
+
+func TestRecover(t *testing.T) {
+	data := `type TData struct{}
+
+// lexWord matches a run of letters after any leading whitespace.
+func (d *TData) lexWord(input string) (int, string, error) {
+	s := strings.TrimLeftFunc(input, unicode.IsSpace)
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i == -1 {
+		i = len(s)
+	}
+	if i == 0 {
+		return 0, "", errors.New("expected word")
+	}
+	return len(input) - len(s) + i, s[:i], nil
+}
+
+// lexStr matches a string in double quotes after any leading whitespace.
+func (d *TData) lexStr(input string) (int, string, error) {
+	s := strings.TrimLeftFunc(input, unicode.IsSpace)
+	if !strings.HasPrefix(s, "\"") {
+		return 0, "", errors.New("expected string")
+	}
+	i := strings.Index(s[1:], "\"")
+	if i == -1 {
+		return 0, "", errors.New("unterminated string")
+	}
+	return len(input) - len(s) + i + 2, s[:i+2], nil
+}`
+	rules := `
+type Program string
+type Statement string
+Program = Statement { Statement } .			Action { return v1 + strings.Join(v2, "") }
+Statement = lex(Word) "=" Value ";" .			Action { return v1 + ";" } Recover { ";" }
+Value = lex(Word) | lex(Str) | "{" { lex(Word) ";" } "}" .
+`
+	checkParse(t, data, rules, []parseTest{
+		{`a = x; b = "y;z"; c = { d; e; };`, "a;b;c;"},
+		{`a = = x; b = y;`, "expected Value at 1:5"},
+		{`a = = "x;y" { z; w; }; b = y;`, "expected Value at 1:5"},
+		{`a = = x; b = y; c = ; d = y;`, "expected Value at 1:5; expected Value at 1:21"},
+	})
+}
+
+func TestGrammarRecover(t *testing.T) {
+	// each production with an error is reported once, and the productions
+	// after it are still parsed, even when its action contains the sync
+	// literal.
+	rules := `
+S = A B C D .
+A = "a" $ . Action { p.out.WriteString("a.b") }
+B = "b" .
+C = "c" "." ( . Action { p.out.WriteString("c") }
+D = "d" .
+`
+	data := "type TData struct{}"
+	_, stderr, err := generate(t, data, rules)
+	if err == nil {
+		t.Fatal("expected errors")
+	}
+	var errs []string
+	for _, v := range strings.Split(stderr, "\n") {
+		if strings.Contains(v, "expected") {
+			errs = append(errs, v)
+		}
+	}
+	// the rules start on the line after the header
+	line := strings.Count(strings.NewReplacer("%DATA%", data, "%INPUT%", "in").Replace(testHeader), "\n") + 1
+	want := []string{fmt.Sprintf("at %v:9", line+2), fmt.Sprintf("at %v:15", line+4)}
+	if len(errs) != len(want) {
+		t.Fatalf("got errors %q, want %v", errs, want)
+	}
+	for i, v := range want {
+		if !strings.HasSuffix(errs[i], v) {
+			t.Errorf("got error %q, want one %v", errs[i], v)
+		}
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	rules := `
+type S string
+S = "a" "b" | "a" "c" "d" .	Action { return "ok" }
+`
+	tests := []parseTest{
+		{"acd", "ok"},
+		{"acx", `expected "b" at 1:2`},
+	}
+	checkParse(t, `type TData struct{}
+
+func (d *TData) ErrorPolicy(stack []*TErrorRecord) []*TErrorRecord {
+	return stack[:1]
+}`, rules, tests)
+
+	tests[1].want = `expected "d" at 1:3`
+	checkParse(t, `type TData struct{}
+
+func (d *TData) ErrorPolicy(stack []*TErrorRecord) []*TErrorRecord {
+	return TFarthestErrors(stack)
+}`, rules, tests)
+}
+
+func TestErrorChains(t *testing.T) {
+	// the error carries the chain of productions of the farthest failure,
+	// and an error policy is given the chain of every error.
+	rules := `
+type S string
+S = A "!" | B .		Action { return "ok" }
+A = "(" C ")" .
+B = "(" C "]" "x" | "(" "d" .
+C = "c" .
+`
+	checkParse(t, `type TData struct{}
+
+func (d *TData) report(in, out string, err error) string {
+	var perr *TParseError
+	if errors.As(err, &perr) {
+		out += " in " + strings.Join(perr.Productions, " > ")
+	}
+	return out
+}`, rules, []parseTest{
+		{"(c)!", "ok"},
+		{"(c]y", `expected "x" at 1:4 in S > B`},
+		{"(x", `expected one of "c", "d" at 1:2 in S > A > C`},
+	})
+
+	checkParse(t, `type TData struct{ records []*TErrorRecord }
+
+func (d *TData) ErrorPolicy(stack []*TErrorRecord) []*TErrorRecord {
+	d.records = stack
+	return nil
+}
+
+func (d *TData) report(in, out string, err error) string {
+	for _, v := range d.records {
+		out += fmt.Sprintf(" [%v %v in %v]", v.Offset, v.Expected, strings.Join(v.Productions, " > "))
+	}
+	return out
+}`, rules, []parseTest{
+		{"(c]y", `expected "x" at 1:4 [2 ")" in S > A] [3 "x" in S > B] [1 "d" in S > B]`},
+	})
+}
+
+func TestInlineActions(t *testing.T) {
+	// a production named Action can be followed by a repetition, as actions
+	// inside of an expression are introduced by =>.
+	rules := `
+type S string
+type Action string
+S = Action { Action }		=> { return v1 + strings.Join(v2, "") }
+  | "(" => { p.depth++ } S ")"	=> { return fmt.Sprint(p.depth) + v2 } .
+Action = "x" | "y" .		Action { if a1Pos == 1 { return v1 }; return v2 }
+`
+	checkParse(t, `type TData struct{ depth int }`, rules, []parseTest{
+		{"xyx", "xyx"},
+		{"((y))", "22y"},
+	})
+
+	// a mid-rule action in a production without any other actions
+	rules = `
+type S string
+S = T { T } .			Action { return fmt.Sprint(p.n) }
+T = "a" => { p.n++ } "b" | "c" .
+`
+	checkParse(t, `type TData struct{ n int }`, rules, []parseTest{
+		{"abcab", "2"},
+		{"cc", "0"},
+	})
+}
+
+func TestAlternativeWithoutAction(t *testing.T) {
+	// alternatives without an action leave the zero value, and their
+	// variables are not used.
+	rules := `
+type S string
+S = "a" lex(Word)	=> { return v2 }
+  | "b" lex(Word)
+  | "c" => { p.seen = true } lex(Word) .
+`
+	checkParse(t, `type TData struct{ seen bool }
+
+func (d *TData) lexWord(input string) (int, string, error) {
+	s := strings.TrimLeftFunc(input, unicode.IsSpace)
+	if s == "" {
+		return 0, "", errors.New("expected word")
+	}
+	return len(input), s, nil
+}`, rules, []parseTest{
+		{"a x", "x"},
+		{"b x", ""},
+		{"c x", ""},
+	})
+}
+
+func TestSeedsFirst(t *testing.T) {
+	data := `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`
+
+	// the left recursive alternative must come first to grow the result
+	_, stderr, err := generate(t, data, `
+type F string
+F = "(" F ")" => { return v2 } | lex(Num) => { return v1 } | F "!" => { return v1 + "!" } .
+`, "-Werror")
+	if err == nil || !strings.Contains(stderr, `warning: F: left recursive alternative F "!" follows "(" F ")"`) {
+		t.Fatalf("expected a warning, got %v: %v", err, stderr)
+	}
+
+	checkParse(t, data, `
+type F string
+F = F "!" => { return v1 + "!" } | "(" F ")" => { return v2 } | lex(Num) => { return v1 } .
+`, []parseTest{
+		{"3!", "3!"},
+		{"(3!)!!", "3!!!"},
+	}, []string{"-Werror"})
+}
+
+func TestEndlessRecursion(t *testing.T) {
+	// the chain names the cycle through the production when there is one,
+	// even if it is not through the first alternative.
+	_, stderr, err := generate(t, "type TData struct{}", `
+S = "s" [ A ] .
+A = B "x" | "(" C ")" .
+C = A .
+B = "[" B "]" .
+`)
+	if want := "state A can never match, as it recurses without end: A > C > A"; err == nil || !strings.Contains(stderr, want) {
+		t.Fatalf("got %v: %v, want %v", err, stderr, want)
+	}
+}
+
+func TestMemo(t *testing.T) {
+	// S parses A up to three times at each position, which takes
+	// exponential time without memoization. Actions of remembered results
+	// only run the first time.
+	data := `type TData struct{ calls int }`
+	rules := `
+type Top string
+type S string
+type A string
+Top = S .			Action { return fmt.Sprint(v1, " ", p.calls) }
+S = A "x"			=> { return v1 + "x" }
+  | A "y"			=> { return v1 + "y" }
+  | A				=> { return v1 } .
+A%v = "(" S ")"			=> { p.calls++; return "(" + v2 + ")" }
+  | "a"				=> { p.calls++; return v1 } .
+`
+	tests := []parseTest{
+		{"a", "a 1"},
+		{"((a)y)", "((a)y) 3"},
+		{"(((a)))x", "(((a)))x 4"},
+		{"((a)z)", `expected one of "x", "y", ")" at 1:5`},
+	}
+	checkParse(t, data, fmt.Sprintf(rules, ""), tests, []string{"-memo"}, []string{"-memo", "-defer"})
+	checkParse(t, data, fmt.Sprintf(rules, " @memo"), tests)
+
+	tests[0].want = "a 3"
+	tests[1].want = "((a)y) 27"
+	tests[2].want = "(((a)))x 40"
+	checkParse(t, data, fmt.Sprintf(rules, ""), tests)
+}
+
+func TestUndo(t *testing.T) {
+	// functions given to ctx.Undo reverse the side effects of actions that
+	// run for input the parser then backtracks over, including when their
+	// results are grown or remembered.
+	data := `type TData struct{ names []string }
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`
+	rules := `
+type S string
+type L string
+type Decl string
+S = L "!" | L "?" .	Action { return strings.Join(p.names, ",") }
+L = L "+" Decl | Decl .	Action { return "" }
+Decl = lex(Num) .	Action {
+	p.names = append(p.names, v1)
+	ctx.Undo(func() { p.names = p.names[:len(p.names)-1] })
+	return v1
+}
+`
+	checkParse(t, data, rules, []parseTest{
+		{"1!", "1"},
+		{"1?", "1"},
+		{"1+2?", "1,2"},
+		{"1+2+3!", "1,2,3"},
+		{"1+2+", "expected Decl at 1:5"},
+	}, nil, []string{"-defer"}, []string{"-memo"})
+
+	// a mid-rule action can undo itself when the rest of its alternative
+	// fails.
+	checkParse(t, `type TData struct{ n int }`, `
+type S string
+S = T { T } .		Action { return fmt.Sprint(p.n) }
+T = "a" => { p.n++; ctx.Undo(func() { p.n-- }) } "b" | "a" "c" .
+`, []parseTest{
+		{"abacab", "2"},
+		{"acac", "0"},
+	})
+}
+
+func TestAlternativeGroups(t *testing.T) {
+	// the groups of each alternative have their own positions, which
+	// alternative actions number from a1Pos.
+	checkParse(t, `type TData struct{}`, `
+type S string
+S = ( "a" | "b" ) "x"	=> { return fmt.Sprint(a1Pos) + v1 + v2 + v3 }
+  | ( "c" | "d" ) "y"	=> { return fmt.Sprint(a1Pos) + v1 + v2 + v3 } .
+`, []parseTest{
+		{"ax", "1ax"},
+		{"bx", "2bx"},
+		{"cy", "1cy"},
+		{"dy", "2dy"},
+	})
+
+	checkParse(t, `type TData struct{}`, `
+type S string
+S = ( "a" | "b" ) "x" | ( "c" | "d" ) "y" .	Action { return fmt.Sprint(a1Pos, a2Pos, a3Pos) }
+`, []parseTest{
+		{"ax", "1 1 0"},
+		{"dy", "2 -1 2"},
+	})
+}
+
+func TestFallibleAlternative(t *testing.T) {
+	// an alternative whose action rejects it leaves the next alternative to
+	// be tried.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`, `
+type S string
+S = lex(Num)	=> fallible { if v1 == "0" { return "", errors.New("zero") }; return v1, nil }
+  | "0"		=> { return "zero" } .
+`, []parseTest{
+		{"5", "5"},
+		{"0", "zero"},
+		{"x", "expected S at 1:1"},
+	}, nil, []string{"-defer"})
+}
+
+func TestDiagnostics(t *testing.T) {
+	// warnings are reported with their line and column, and Fail ends the
+	// parse with its error. Positions past either end of the input, from
+	// actions or lexer functions, are reported at that end.
+	checkParse(t, `type TData struct{ TDiagnostics }
+
+func (d *TData) report(in, out string, err error) string {
+	for _, w := range d.Warnings() {
+		out += fmt.Sprintf(" [%v %v:%v %v]", w.Offset, w.Line, w.Column, w.Message)
+	}
+	return out
+}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }
+
+func (d *TData) lexFar(input string) (int, string, error) {
+	if strings.HasPrefix(strings.TrimSpace(input), "?") {
+		return 0, "", &TLexError{Offset: len(input) + 10, Err: errors.New("far")}
+	}
+	return 0, "", errors.New("expected far")
+}`, `
+type S string
+type Item string
+S = Item { Item } "." .		Action { return v1 + strings.Join(v2, "") }
+Item = lex(Num)			=> {
+		switch v1 {
+		case "0":
+			p.Warn(pos+100, "zero")
+		case "5":
+			p.Warn(ctx.Start, "five")
+		case "7":
+			p.Warn(pos-100, "seven")
+		case "9":
+			p.Fail(pos+100, errors.New("nine"))
+		}
+		return v1
+	}
+  | lex(Far)			=> { return v1 } .
+`, []parseTest{
+		{"1 2.", "12"},
+		{"1\n 5.", "15 [3 2:2 five]"},
+		{"1 0.", "10 [4 1:5 zero]"},
+		{"7.", "7 [0 1:1 seven]"},
+		{"1 9.", "nine at 1:5"},
+		{"1 ?", "expected Far at 1:4"},
+	}, nil, []string{"-defer"})
+}
+
+func TestFallibleActions(t *testing.T) {
+	// an action that rejects its production fails it like a term would,
+	// and its error replaces what the production expected where it
+	// stopped.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexDigit(input string) (int, string, error) {
+	if input == "" || input[0] < '1' || input[0] > '3' {
+		return 0, "", errors.New("expected digit")
+	}
+	return 1, input[:1], nil
+}`, `
+type Top string
+type S string
+type Num string
+Top = S | "1111" .		Action { if a1Pos == 2 { return "ones" }; return v1 }
+S = Num { "," Num } .		Action { return v1 + strings.Join(v3, "") }
+Num = lex(Digit) { lex(Digit) } .	Action fallible {
+	s := v1 + strings.Join(v2, "")
+	if len(s) > 3 {
+		return "", errors.New("too long")
+	}
+	return s, nil
+}
+`, []parseTest{
+		{"12,3", "123"},
+		{"1231", "too long at 1:5"},
+		{"1111", "ones"},
+		{"1,2222", "too long at 1:7"},
+		{"1,x", "expected Num at 1:3"},
+	}, nil, []string{"-defer"})
+}
+
+func TestRuntimeParameters(t *testing.T) {
+	// arguments can use the parameters of the production, and the values
+	// of earlier terms by position or binding.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`, `
+type S string
+type Item string
+type Tag string
+S = Item(0) { Item(0) } n:lex(Num) Tag(n + "!") .	Action { return v1 + strings.Join(v2, "") + v4 }
+Item(depth int) = "(" Item(depth+1) { Item(depth+1) } ")"	=> { return "(" + v2 + strings.Join(v3, "") + ")" }
+	| "x"							=> { return fmt.Sprint(depth) } .
+Tag(s string) = "." .					Action { return s }
+`, []parseTest{
+		{"x3.", "03!"},
+		{"x(x(x)x)x 7.", "0(1(2)1)07!"},
+	}, nil, []string{"-defer"})
+
+	// parameters can't use the names of the generated code
+	for _, v := range []struct{ param, want string }{
+		{"pos int", "pos is used by the generated parser"},
+		{"v1 int", "v1 is used by the generated parser"},
+		{"a2Pos int", "a2Pos is used by the generated parser"},
+		{"ret int", "ret is used by the generated parser"},
+		{"type int", "type is a Go keyword"},
+		{"string int", "string is predeclared in Go"},
+		{"x int, x int", "x already declared"},
+	} {
+		_, stderr, err := generate(t, "type TData struct{}", fmt.Sprintf(`
+S = D(1) .
+D(%v) = "d" .
+`, v.param))
+		if err == nil || !strings.Contains(stderr, v.want) {
+			t.Errorf("%v: got %v: %v, want %v", v.param, err, stderr, v.want)
+		}
+	}
+}
+
+func TestBindings(t *testing.T) {
+	// bound terms inside of repetitions are slices, and terms without a
+	// binding keep their positional variable.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`, `
+type S string
+type T string
+S = lhs:T { op:"+" rhs:T } .	Action { r := lhs; for i := range op { r = "(" + r + op[i] + rhs[i] + ")" }; return r }
+T = n:lex(Num)			=> { return n }
+  | "[" x:lex(Num) "]"		=> { return v1 + x + v3 } .
+`, []parseTest{
+		{"1", "1"},
+		{"1+2+3", "((1+2)+3)"},
+		{"[4]+5", "([4]+5)"},
+	})
+
+	for _, v := range []struct{ rules, want string }{
+		{`S = type:"a" .`, "type is a Go keyword"},
+		{`S = len:"a" .`, "len is predeclared in Go"},
+		{`S = pos:"a" .`, "pos is used by the generated parser"},
+		{`S = x:"a" ctx:"b" .`, "ctx is used by the generated parser"},
+		{`S = x:"a" x:"b" .`, "x already declared"},
+		{`S = x:( "a" ) .`, "only names, literals, and lexer functions can be bound"},
+		{`S = D(1) . D(x int) = x:"a" .`, "x already declared"},
+	} {
+		_, stderr, err := generate(t, "type TData struct{}", "\n"+v.rules+"\n")
+		if err == nil || !strings.Contains(stderr, v.want) {
+			t.Errorf("%v: got %v: %v, want %v", v.rules, err, stderr, v.want)
+		}
+	}
+}
+
+func TestParseError(t *testing.T) {
+	// the error is a *TParseError, with the offset, line, and column of the
+	// failure. Columns count runes, and in token mode, the column is the
+	// token number.
+	data := `type TData struct{}
+
+func (d *TData) report(in, out string, err error) string {
+	var perr *TParseError
+	if errors.As(err, &perr) {
+		out = fmt.Sprintf("%v %v:%v %v: %v", perr.Offset, perr.Line, perr.Column, perr.Production, out)
+	}
+	return out
+}`
+	rules := `
+type S string
+S = "ä" { "," "ä" } .	Action { return "ok" }
+`
+	checkParse(t, data, rules, []parseTest{
+		{"ä,ä", "ok"},
+		{"ä,ä,\n ä,x", `11 2:4 S: expected "ä" at 2:4`},
+		{"x", "0 1:1 : expected S at 1:1"},
+	})
+	checkParse(t, data, rules, []parseTest{
+		{"ä , ä", "ok"},
+		{"ä , ä , x", `4 1:5 S: expected "ä" at 1:5`},
+	}, []string{"-token"})
+}
+
+func TestExpectedOneOf(t *testing.T) {
+	// the literals, lexer functions, and productions expected at the
+	// farthest failure are reported together.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }
+
+func (d *TData) report(in, out string, err error) string {
+	var perr *TParseError
+	if errors.As(err, &perr) {
+		out += " " + strings.Join(perr.Expected, "|")
+	}
+	return out
+}`, `
+type S string
+S = "(" ( "+" | "-" | Value ) ")" .	Action { return "ok" }
+Value = lex(Num) | "x" lex(Num) .
+`, []parseTest{
+		{"(+)", "ok"},
+		{"(*", `expected one of "+", "-", Value at 1:2 "+"|"-"|Value`},
+		{"(x)", `expected Num at 1:3 Num`},
+		{"(1", `expected ")" at 1:3 ")"`},
+	})
+}
+
+func TestPretty(t *testing.T) {
+	// Pretty shows the line of the failure, with a caret under its column
+	// that lines up with tabs in the input.
+	data := `type TData struct{}
+
+func (d *TData) report(in, out string, err error) string {
+	var perr *TParseError
+	if errors.As(err, &perr) {
+		out = perr.Pretty(%v)
+	}
+	return out
+}`
+	rules := `
+type S string
+S = "ä" { "," "ä" } .	Action { return "ok" }
+`
+	checkParse(t, fmt.Sprintf(data, "in"), rules, []parseTest{
+		{"ä,ä", "ok"},
+		{"ä,\n\tä,x\nä", "expected \"ä\" at 2:4; \tä,x; \t  ^"},
+		{"ä,", "expected \"ä\" at 1:3; ä,;   ^"},
+	})
+	checkParse(t, fmt.Sprintf(data, "strings.Fields(in)"), rules, []parseTest{
+		{"ä , x", "expected \"ä\" at 1:3; ä , x;     ^"},
+		{"ä ,", "expected \"ä\" at 1:3; ä ,;     ^"},
+	}, []string{"-token"})
+}
+
+func TestLabels(t *testing.T) {
+	// a label replaces what its term expects, unless the term got past its
+	// start.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`, `
+type S string
+S = "(" Sum ")" @"closing parenthesis" { "," lex(Num) @"number" } [ ( "!" "?" ) @"question" ] .	Action { return "ok" }
+Sum = lex(Num) { "+" lex(Num) } .
+`, []parseTest{
+		{"(1+2),3!?", "ok"},
+		{"(1+2", `expected one of "+", closing parenthesis at 1:5`},
+		{"(1),x", "expected number at 1:5"},
+		{"(1)!", `expected "?" at 1:5`},
+		{"(1)x", `expected one of ",", question at 1:4`},
+	})
+}
+
+func TestErrorRecover(t *testing.T) {
+	// a production whose Error block recovers succeeds with the substitute
+	// value, and the error it returns, if any, is still reported.
+	checkParse(t, `type TData struct{ result string }
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }
+
+func (d *TData) report(in, out string, err error) string {
+	if err != nil && d.result != "" {
+		return d.result + " " + out
+	}
+	return out
+}`, `
+type S string
+type Item string
+S = Item { "," Item } "." .	Action { p.result = v1 + strings.Join(v3, ""); return p.result }
+Item = "<" lex(Num) ">" .	Action { return v2 }
+	Error recover {
+		if errPos == pos+1 {
+			return "?", true, nil
+		}
+		return "!", true, fmt.Errorf("bad item at %v", errPos)
+	}
+	Recover { ">" }
+`, []parseTest{
+		{"<1>,<2>.", "12"},
+		{"<1>,<x>.", "1?"},
+		{"<1>,<2;>,<x>.", "1!? bad item at 6"},
+		{"<1>,<x>", `expected one of ",", "." at 1:8`},
+	})
+}
+
+func TestLexErrorOffset(t *testing.T) {
+	// a lexer function's error is recorded at the start of its input, or at
+	// the Offset of a TLexError, and the length it returns with an error is
+	// ignored. Literals are expected after leading whitespace.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexWord(input string) (int, string, error) {
+	s := strings.TrimLeftFunc(input, unicode.IsSpace)
+	n := len(input) - len(s)
+	i := strings.IndexFunc(s, func(r rune) bool { return !unicode.IsLetter(r) })
+	if i == -1 {
+		i = len(s)
+	}
+	if i > 0 {
+		return n + i, s[:i], nil
+	}
+	if s != "" && unicode.IsDigit(rune(s[0])) {
+		return 0, "", &TLexError{Offset: n + 1, Err: errors.New("digit in word")}
+	}
+	return 5, "", errors.New("not a word")
+}
+
+func (d *TData) report(in, out string, err error) string {
+	var perr *TParseError
+	if errors.As(err, &perr) {
+		out += " " + strings.Join(perr.Messages, "|")
+	}
+	return out
+}`, `
+type S string
+S = "a" ( lex(Word) | "!" ) [ "." ] .	Action { return "ok" }
+`, []parseTest{
+		{"a  w.", "ok"},
+		{"a  ?", `expected "!" at 1:4 expected !`},
+		{"a  1", "expected Word at 1:5 digit in word"},
+		{"a", `expected one of Word, "!" at 1:2 not a word|expected !`},
+	})
+}
+
+func TestDefer(t *testing.T) {
+	// with -defer, actions without a type run once the input they matched
+	// can't be backtracked, with the position they had when they matched,
+	// and not at all for input that is backtracked.
+	data := `type TData struct{ log []string }
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`
+	rules := `
+type S string
+S = { Stmt } "." .	Action { return strings.Join(p.log, ",") }
+Stmt = Call "!" | Call "?" .
+Call = lex(Num) .	Action { p.log = append(p.log, fmt.Sprintf("%v@%v", v1, pos)) }
+`
+	tests := []parseTest{
+		{"1! 2!.", "1@1,2@4"},
+		{"1? 2!.", "1@1,1@1,2@4"},
+	}
+	checkParse(t, data, rules, tests)
+
+	tests[1].want = "1@1,2@4"
+	checkParse(t, data, rules, tests, []string{"-defer"}, []string{"-defer", "-memo"})
+}
+
+func TestContext(t *testing.T) {
+	// ctx describes what the production matched, after any leading
+	// whitespace. In token mode, offsets and columns count tokens.
+	rules := `
+type S string
+type Item string
+S = Item { Item } .	Action { return v1 + strings.Join(v2, "") + " " + ctx.Text() }
+Item = "x" | "yy" .	Action { return fmt.Sprintf("[%v %v-%v %v:%v %v]", ctx.Production, ctx.Start, ctx.End, ctx.Line(), ctx.Column(), ctx.Text()) }
+`
+	checkParse(t, "type TData struct{}", rules, []parseTest{
+		{" x\n  yy x", "[Item 1-2 1:2 x][Item 5-7 2:3 yy][Item 8-9 2:6 x] x;   yy x"},
+	})
+	checkParse(t, "type TData struct{}", rules, []parseTest{
+		{"x yy x", "[Item 0-1 1:1 x][Item 1-2 1:2 yy][Item 2-3 1:3 x] x yy x"},
+	}, []string{"-token"})
+}
+
+func TestParameterizedProductions(t *testing.T) {
+	// each use of a parameterized production creates an instance, which
+	// has the type of its arguments and is named after them in errors.
+	checkParse(t, `type TData struct{}
+
+func (d *TData) lexNum(input string) (int, string, error) { return lexNum(input) }`, `
+type S string
+type Number string
+type Word string
+type CommaList(X) []X
+type Bracket(X) string
+S = "(" CommaList(Number) ")" Bracket(Word) .		Action { return strings.Join(v2, "+") + " " + v4 }
+CommaList(X) = first:X { "," rest:X } .			Action { return append([]X{first}, rest...) }
+Bracket(X) = "[" CommaList(X) "]" .			Action { return strings.Join(v2, "+") }
+Number = lex(Num) .					Action { return v1 }
+Word = "a" | "b" .					Action { if a1Pos == 1 { return v1 }; return v2 }
+`, []parseTest{
+		{"(1,2)[a,b,a]", "1+2 a+b+a"},
+		{"(1", `expected one of ",", ")" at 1:3`},
+		{"(1)", "expected Bracket(Word) at 1:4"},
+		{"(1)[a,", `expected one of "a", "b" at 1:7`},
+	})
+
+	// arguments must be productions, and each parameterized production
+	// must be used.
+	for _, v := range []struct{ rules, want string }{
+		{`S = L("x") .
+L(X) = X .`, `argument "\"x\"" is not a production name`},
+		{`S = "s" .
+L(X) = X .`, "state L defined but not used"},
+		{`S = L(S, S) .
+L(X) = X .`, "L takes 1 arguments, got 2"},
+	} {
+		_, stderr, err := generate(t, "type TData struct{}", v.rules)
+		if err == nil || !strings.Contains(stderr, v.want) {
+			t.Errorf("%v: got %v: %v, want %v", v.rules, err, stderr, v.want)
+		}
+	}
+}
+
+func TestShadowed(t *testing.T) {
+	// alternatives that an earlier alternative always matches first are
+	// warned about, and are errors with -Werror.
+	for _, v := range []struct {
+		rules string
+		flags []string
+		want  string
+	}{
+		{`S = "Cat" | "Caterpillar" .`, nil, `S: alternative "Caterpillar" can never match, as the earlier alternative "Cat" always matches first`},
+		{`S = [ "a" ] | "b" .`, nil, `S: alternative "b" can never match, as the earlier alternative [ "a" ] always matches first`},
+		{`S = "s" ( A "(" | A "(" A ")" ) .
+A = "a" .`, nil, `S: alternative A "(" A ")" can never match, as the earlier alternative A "(" always matches first`},
+		{`S = "Caterpillar" | "Cat" .`, nil, ""},
+		{`S = "Cat" | "Caterpillar" .`, []string{"-token"}, ""},
+	} {
+		_, stderr, err := generate(t, "type TData struct{}", v.rules, v.flags...)
+		if err != nil {
+			t.Fatalf("%v: %v: %v", v.rules, err, stderr)
+		}
+		if v.want == "" {
+			if strings.Contains(stderr, "warning") {
+				t.Errorf("%v %v: got %v, want no warning", v.rules, v.flags, stderr)
+			}
+			continue
+		}
+		if !strings.Contains(stderr, "warning: "+v.want) {
+			t.Errorf("%v %v: got %v, want %v", v.rules, v.flags, stderr, v.want)
+		}
+		if _, stderr, err := generate(t, "type TData struct{}", v.rules, append(v.flags, "-Werror")...); err == nil {
+			t.Errorf("%v: -Werror succeeded: %v", v.rules, stderr)
+		}
+	}
+
+	// the warning is right: the longer literal is never matched.
+	checkParse(t, "type TData struct{}", `
+type S string
+S = "Cat" | "Caterpillar" .	Action { if a1Pos == 1 { return v1 }; return v2 }
+`, []parseTest{
+		{"Cat", "Cat"},
+		{"Caterpillar", "unexpected input at 1:4"},
+	})
+}
+
+// analyze returns what pbpg prints for the grammar with -analyze, with runs
+// of spaces collapsed so that the columns of tables don't matter.
+func analyze(t *testing.T, rules string) string {
+	t.Helper()
+	dir := t.TempDir()
+	grammar := strings.NewReplacer("%DATA%", "type TData struct{}", "%INPUT%", "in").Replace(testHeader) + rules
+	if err := os.WriteFile(filepath.Join(dir, "g.b"), []byte(grammar), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(generator(t), "-analyze", "g.b")
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("pbpg -analyze: %v", err)
+	}
+	var lines []string
+	for _, v := range strings.Split(string(out), "\n") {
+		lines = append(lines, strings.Join(strings.Fields(v), " "))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestFirstFollow(t *testing.T) {
+	// -analyze prints the FIRST and FOLLOW sets of each production, the
+	// alternatives that can start with the same token, and which
+	// productions are LL(1).
+	out := analyze(t, `
+S = A "x" | A "y" | "z" { B } .
+A = "a" [ B ] .
+B = "b" | lex(Num) .
+`)
+	for _, want := range []string{
+		`S "a", "z" $`,
+		`A "a" "x", "y"`,
+		`B "b", lex(Num) "b", "x", "y", $, lex(Num)`,
+		`S: alternatives A "x" and A "y" can both start with "a"`,
+		`LL(1): 2 of 3 productions`,
+		`LL(1): A, B`,
+		`may backtrack: S`,
+	} {
+		if !strings.Contains(out, "\n"+want+"\n") {
+			t.Errorf("missing %q in:\n%v", want, out)
+		}
+	}
+}
+
+func TestCost(t *testing.T) {
+	// -analyze estimates how much each production can backtrack, and
+	// suggests how to left factor alternatives that start alike.
+	out := analyze(t, `
+Top = S | B | T .
+S = A "x" | A "y" | A .
+A = "(" S ")" | "a" .
+B = C "x" | C "y" .
+C = "c" .
+T = "t" "u" | "t" "v" .
+`)
+	for _, want := range []string{
+		`S exponential: alternatives A "x" | A "y" | A start with the same token, and re-parse A, and A can lead back to S`,
+		`A exponential: uses S`,
+		`B backtracking, up to 2x: alternatives C "x" | C "y" start with the same token, and re-parse C`,
+		`C linear`,
+		`T linear, backtracks over tokens: alternatives "t" "u" | "t" "v" start with the same token`,
+		`S: A "x" | A "y" | A can be left factored as A [ "x" | "y" ]`,
+		`B: C "x" | C "y" can be left factored as C ( "x" | "y" )`,
+	} {
+		if !strings.Contains(out, "\n"+want+"\n") {
+			t.Errorf("missing %q in:\n%v", want, out)
+		}
+	}
+}
@@ -81,11 +81,11 @@ func (p *pbpgData) lexname(input string) (int, string, error) {
 			continue
 		}
 		if len(val) == 0 {
-			return 0, "", fmt.Errorf("could not extract name, got %v", string(r))
+			return 0, "", &pbpgLexError{Offset: offset, Err: fmt.Errorf("could not extract name, got %v", string(r))}
 		}
 		return offset, val, nil
 	}
-	return 0, "", fmt.Errorf("could not extract token")
+	return 0, "", &pbpgLexError{Offset: offset, Err: fmt.Errorf("could not extract token")}
 }
 
 func (p *pbpgData) lexfunctionname(input string) (int, string, error) {
@@ -145,3 +145,119 @@ func (p *pbpgData) lextype(input string) (int, string, error) {
 	}
 	return offset, token, nil
 }
+
+// lexparameters extracts the parameter list of a production, which is
+// everything between a pair of balanced parentheses.
+func (p *pbpgData) lexparameters(input string) (int, string, error) {
+	return lexparens(input, countLeadingWhitespace(input))
+}
+
+// lexarguments extracts the arguments given to a production. Unlike
+// parameters, the parentheses must immediately follow the production name, as
+// a name followed by a group would otherwise be ambiguous.
+func (p *pbpgData) lexarguments(input string) (int, string, error) {
+	return lexparens(input, 0)
+}
+
+// lexparens returns the text between the parentheses starting at offset,
+// tracking nested parentheses and quoted strings.
+func lexparens(input string, offset int) (int, string, error) {
+	if r, _ := getRune(input, offset); r != '(' {
+		return 0, "", &pbpgLexError{Offset: offset, Err: fmt.Errorf("expected (")}
+	}
+	start := offset + 1
+	offset = start
+	depth := 0
+	var quote rune
+	escape := false
+
+	for r, s := getRune(input, offset); s > 0; r, s = getRune(input, offset) {
+		offset += s
+
+		if escape {
+			escape = false
+			continue
+		}
+
+		if quote != 0 {
+			switch {
+			case r == '\\' && quote != '`':
+				escape = true
+			case r == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch r {
+		case '"', '\'', '`':
+			quote = r
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return offset, input[start : offset-1], nil
+			}
+			depth--
+		}
+	}
+	return 0, "", &pbpgLexError{Offset: start - 1, Err: fmt.Errorf("unbalanced parentheses")}
+}
+
+// splitList splits a comma separated list, such as the parameters or
+// arguments of a production, ignoring commas inside of parentheses, brackets,
+// braces, and quoted strings. Each element is trimmed of whitespace.
+func splitList(input string) []string {
+	var r []string
+	start := 0
+	depth := 0
+	var quote rune
+	escape := false
+
+	for i, c := range input {
+		if escape {
+			escape = false
+			continue
+		}
+		if quote != 0 {
+			switch {
+			case c == '\\' && quote != '`':
+				escape = true
+			case c == quote:
+				quote = 0
+			}
+			continue
+		}
+
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '(', '[', '{':
+			depth++
+		case ')', ']', '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				r = append(r, strings.TrimSpace(input[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	if s := strings.TrimSpace(input[start:]); s != "" || len(r) > 0 {
+		r = append(r, s)
+	}
+	return r
+}
+
+// isName returns true if s could be lexed as a single production name.
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsLetter(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,369 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"fmt"
+	"go/token"
+	"go/types"
+	"strings"
+	"unicode"
+)
+
+// A Parameter is a runtime parameter of a production, such as "prec int" in
+// "Expr(prec int)".
+type Parameter struct {
+	name string
+	typ  string
+}
+
+// parseParameters splits the parameters of a production into the parameters
+// of a parameterized production, which are all production names, or runtime
+// parameters, which are all Go parameters with a name and a type.
+func parseParameters(list []string) ([]string, []Parameter, error) {
+	names := true
+	for _, v := range list {
+		names = names && isName(v)
+	}
+	if names {
+		return list, nil, nil
+	}
+
+	var r []Parameter
+	seen := make(map[string]bool)
+	for _, v := range list {
+		i := strings.IndexFunc(v, unicode.IsSpace)
+		if i == -1 || !isIdent(v[:i]) {
+			return nil, nil, fmt.Errorf("parameter %q must be a production name, or a Go parameter with a name and a type", v)
+		}
+		if err := checkName(v[:i]); err != nil {
+			return nil, nil, fmt.Errorf("parameter %q: %w", v, err)
+		}
+		if seen[v[:i]] {
+			return nil, nil, fmt.Errorf("parameter %q: %v already declared", v, v[:i])
+		}
+		seen[v[:i]] = true
+		r = append(r, Parameter{name: v[:i], typ: strings.TrimSpace(v[i:])})
+	}
+	return nil, r, nil
+}
+
+// reservedNames are the names the generated state, action, and Error functions
+// use for their own variables and parameters.
+var reservedNames = map[string]bool{
+	"p":         true,
+	"pos":       true,
+	"ctx":       true,
+	"err":       true,
+	"errPos":    true,
+	"entryPos":  true,
+	"entryMark": true,
+	"altMark":   true,
+	"ret":       true,
+	"terr":      true,
+	"rret":      true,
+	"rerr":      true,
+	"recovered": true,
+	"labelPos":  true,
+	"labelMark": true,
+	"repPos":    true,
+}
+
+// checkName returns an error if the name of a runtime parameter or binding
+// can't be used in the generated code, as it is a Go keyword or predeclared
+// identifier, or a name the generated code uses itself.
+func checkName(name string) error {
+	switch {
+	case token.IsKeyword(name):
+		return fmt.Errorf("%v is a Go keyword", name)
+	case types.Universe.Lookup(name) != nil:
+		return fmt.Errorf("%v is predeclared in Go", name)
+	case reservedNames[name] || generatedName(name):
+		return fmt.Errorf("%v is used by the generated parser", name)
+	}
+	return nil
+}
+
+// generatedName returns true if name is one of the variables generated for
+// the terms and alternatives of a production: v<n>, v<n>temp, v<n>ErrorStack,
+// or a<n>Pos.
+func generatedName(name string) bool {
+	digits := func(s string) bool {
+		return s != "" && strings.Trim(s, "0123456789") == ""
+	}
+	switch {
+	case strings.HasPrefix(name, "a") && strings.HasSuffix(name, "Pos"):
+		return len(name) > 4 && digits(name[1:len(name)-3])
+	case strings.HasPrefix(name, "v"):
+		return digits(strings.TrimSuffix(strings.TrimSuffix(name[1:], "temp"), "ErrorStack"))
+	}
+	return false
+}
+
+// isIdent returns true if s is a Go identifier.
+func isIdent(s string) bool {
+	for i, r := range s {
+		if r != '_' && !unicode.IsLetter(r) && (i == 0 || !unicode.IsDigit(r)) {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// A macroType is the type declared for a parameterized production, such as
+// "type CommaList(X) []X". The parameters stand for the types of the
+// arguments the production is used with.
+type macroType struct {
+	params []string
+	typ    string
+}
+
+// expand creates an instance of a parameterized production for every set of
+// arguments it is used with, starting from the productions that are not
+// parameterized. Instances are named after the production and its arguments,
+// such as CommaList_Expression for CommaList(Expression), and are added to the
+// grammar like any other production. Instances can use other parameterized
+// productions, which are expanded in turn.
+func (p *pbpgData) expand() error {
+	var queue []*Production
+	for _, v := range p.lines {
+		if v.production != nil && v.production.params == nil {
+			queue = append(queue, v.production)
+		}
+	}
+
+	if _, ok := p.inherited[p.entryPoint]; ok {
+		return fmt.Errorf("the entrypoint %v cannot have parameters", p.entryPoint)
+	}
+
+	for len(queue) > 0 {
+		prod := queue[0]
+		queue = queue[1:]
+
+		err := prod.exp.walk(func(t *Term) error {
+			if t.option != TERM_NAME {
+				return nil
+			}
+			if params, ok := p.inherited[t.name]; ok {
+				if len(t.args) != len(params) {
+					return fmt.Errorf("%v: %v: %v takes %v arguments, got %v", prod.name, t, t.name, len(params), len(t.args))
+				}
+				return nil
+			}
+			if t.args == nil {
+				return nil
+			}
+			inst, err := p.instantiate(t)
+			if err != nil {
+				return fmt.Errorf("%v: %v: %w", prod.name, t, err)
+			}
+			if inst != nil {
+				queue = append(queue, inst)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// bindings can only be checked once the types of instances are known
+	for _, k := range p.orderedStates {
+		err := p.stateMap[k].walk(func(t *Term) error {
+			if t.binding == "" || t.option != TERM_NAME {
+				return nil
+			}
+			if _, ok := p.typeMap[t.state()]; !ok {
+				return fmt.Errorf("%v: %v: %v has no type", k, t, t.name)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// instantiate returns the instance of the parameterized production the term
+// uses, or nil if the instance already exists.
+func (p *pbpgData) instantiate(t *Term) (*Production, error) {
+	macro := p.macros[t.name]
+	if macro == nil {
+		return nil, fmt.Errorf("%v is not a parameterized production", t.name)
+	}
+	if len(t.args) != len(macro.params) {
+		return nil, fmt.Errorf("%v takes %v arguments, got %v", t.name, len(macro.params), len(t.args))
+	}
+	for _, v := range t.args {
+		if !isName(v) {
+			return nil, fmt.Errorf("argument %q is not a production name", v)
+		}
+	}
+
+	t.instance = t.name + "_" + strings.Join(t.args, "_")
+	if _, ok := p.stateMap[t.instance]; ok {
+		return nil, nil
+	}
+
+	names := make(map[string]string)
+	for i, v := range macro.params {
+		names[v] = t.args[i]
+	}
+
+	// the parameters of the type, and in the code of the action and Error
+	// blocks, stand for the types of the arguments.
+	types := make(map[string]string)
+	if mt, ok := p.macroTypes[t.name]; ok {
+		if len(mt.params) != len(macro.params) {
+			return nil, fmt.Errorf("the type of %v has %v parameters, but %v has %v", t.name, len(mt.params), t.name, len(macro.params))
+		}
+		for i, v := range mt.params {
+			if ftype, ok := p.typeMap[t.args[i]]; ok {
+				types[v] = strings.TrimSpace(ftype)
+			} else if usesIdent(mt.typ, v) {
+				return nil, fmt.Errorf("%v has no type", t.args[i])
+			}
+		}
+		p.typeMap[t.instance] = substituteIdents(mt.typ, types)
+	}
+
+	inst := &Production{
+		name: t.instance,
+		exp:  macro.exp.substitute(names),
+		sync: macro.sync,
+		memo: macro.memo,
+		call: fmt.Sprintf("%v(%v)", t.name, strings.Join(t.args, ", ")),
+	}
+	if macro.action != nil {
+		inst.action = &ActionBlock{code: substituteIdents(macro.action.code, types), fallible: macro.action.fallible}
+	}
+	if macro.errorBlock != nil {
+		inst.errorBlock = &ErrorBlock{code: substituteIdents(macro.errorBlock.code, types), recover: macro.errorBlock.recover}
+	}
+
+	p.stateMap[inst.name] = inst.exp
+	p.orderedStates = append(p.orderedStates, inst.name)
+	p.instances[t.name] = append(p.instances[t.name], inst)
+	return inst, nil
+}
+
+// walk calls f for every term in the expression, including the terms inside
+// of groups, options, and repetitions.
+func (e *Expression) walk(f func(t *Term) error) error {
+	for _, a := range e.alternatives {
+		for _, t := range a.terms {
+			if err := f(t); err != nil {
+				return err
+			}
+			if t.option == TERM_GOR {
+				if err := t.gor.expression.walk(f); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// substitute returns a copy of the expression with each production name, and
+// each argument, found in m replaced with its value.
+func (e *Expression) substitute(m map[string]string) *Expression {
+	r := &Expression{}
+	for _, a := range e.alternatives {
+		na := &Alternative{}
+		if a.action != nil {
+			na.action = &ActionBlock{code: a.action.code, fallible: a.action.fallible}
+		}
+		for _, t := range a.terms {
+			nt := *t
+			if v, ok := m[t.name]; ok && t.option == TERM_NAME {
+				nt.name = v
+			}
+			if t.args != nil {
+				nt.args = make([]string, len(t.args))
+				for i, v := range t.args {
+					if s, ok := m[v]; ok {
+						v = s
+					}
+					nt.args[i] = v
+				}
+			}
+			if t.option == TERM_GOR {
+				nt.gor = &GOR{option: t.gor.option, expression: t.gor.expression.substitute(m)}
+			}
+			nt.instance = ""
+			na.terms = append(na.terms, &nt)
+		}
+		r.alternatives = append(r.alternatives, na)
+	}
+	return r
+}
+
+// usesIdent returns true if the identifier appears in the Go source code,
+// outside of strings and comments.
+func usesIdent(code string, ident string) bool {
+	return substituteIdents(code, map[string]string{ident: ident + "."}) != code
+}
+
+// substituteIdents replaces each identifier in the Go source code with its
+// value in m, if it has one. Identifiers inside of strings and comments, and
+// those following a ".", are left alone.
+func substituteIdents(code string, m map[string]string) string {
+	if len(m) == 0 {
+		return code
+	}
+
+	isIdent := func(r rune, first bool) bool {
+		return r == '_' || unicode.IsLetter(r) || (!first && unicode.IsDigit(r))
+	}
+
+	var out strings.Builder
+	rs := []rune(code)
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		j := i + 1
+		switch {
+		case r == '"' || r == '\'' || r == '`':
+			for j < len(rs) && rs[j] != r {
+				if rs[j] == '\\' && r != '`' {
+					j++
+				}
+				j++
+			}
+			if j < len(rs) {
+				j++
+			}
+		case r == '/' && j < len(rs) && rs[j] == '/':
+			for j < len(rs) && rs[j] != '\n' {
+				j++
+			}
+		case r == '/' && j < len(rs) && rs[j] == '*':
+			for j++; j < len(rs) && !(rs[j-1] == '*' && rs[j] == '/'); j++ {
+			}
+			if j < len(rs) {
+				j++
+			}
+		case isIdent(r, true):
+			for j < len(rs) && isIdent(rs[j], false) {
+				j++
+			}
+			if v, ok := m[string(rs[i:j])]; ok && (i == 0 || rs[i-1] != '.') {
+				out.WriteString(v)
+				i = j
+				continue
+			}
+		}
+		if j > len(rs) {
+			j = len(rs)
+		}
+		out.WriteString(string(rs[i:j]))
+		i = j
+	}
+	return out.String()
+}
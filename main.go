@@ -1,4 +1,4 @@
-//go:generate pbpg pbpg.b
+//go:generate pbpg -defer pbpg.b
 
 /*************************************************************************
  * Copyright 2022 Gravwell, Inc. All rights reserved.
@@ -10,6 +10,7 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"go/format"
@@ -21,11 +22,15 @@ import (
 )
 
 var (
-	fPrefix = flag.String("prefix", "pbpg", "Prefix for user parser, data structs, and filename.")
-	fStub   = flag.Bool("stub", false, "Write lexer/merge/data stub to <prefix>Data.go")
-	fDebug  = flag.Bool("debug", false, "Enable debug output to stderr in the generated parser.")
-	fToken  = flag.Bool("token", false, "Use token mode instead of a string based lexer.")
-	fPrint  = flag.Bool("p", false, "print the formatted grammar to stdout and exit.")
+	fPrefix  = flag.String("prefix", "pbpg", "Prefix for user parser, data structs, and filename.")
+	fStub    = flag.Bool("stub", false, "Write lexer/merge/data stub to <prefix>Data.go")
+	fDebug   = flag.Bool("debug", false, "Enable debug output to stderr in the generated parser.")
+	fToken   = flag.Bool("token", false, "Use token mode instead of a string based lexer.")
+	fPrint   = flag.Bool("p", false, "print the formatted grammar to stdout and exit.")
+	fDefer   = flag.Bool("defer", false, "Defer actions of productions without a type until the parser can no longer backtrack over them.")
+	fWerror  = flag.Bool("Werror", false, "Treat warnings about the grammar as errors.")
+	fAnalyze = flag.Bool("analyze", false, "print the FIRST and FOLLOW sets and LL(1) conflicts of the grammar to stdout and exit.")
+	fMemo    = flag.Bool("memo", false, "Remember the results of every production without runtime parameters at each position, for linear time parsing.")
 )
 
 const (
@@ -48,11 +53,31 @@ func main() {
 	data := &pbpgData{
 		typeMap:    make(map[string]string),
 		stateMap:   make(map[string]*Expression),
-		statesUsed: make(map[string]bool),
+		macros:     make(map[string]*Production),
+		inherited:  make(map[string][]Parameter),
+		macroTypes: make(map[string]*macroType),
+		instances:  make(map[string][]*Production),
 	}
 	err = Parsepbpg(string(input), data)
 	if err != nil {
 		fmt.Println(data.out.String())
+		var perrs pbpgParseErrors
+		if !errors.As(err, &perrs) {
+			perrs = pbpgParseErrors{err}
+		}
+		for _, v := range perrs {
+			var perr *pbpgParseError
+			if errors.As(v, &perr) {
+				log.Println(perr.Pretty(string(input)))
+			} else {
+				log.Println(v)
+			}
+		}
+		os.Exit(1)
+	}
+
+	err = data.expand()
+	if err != nil {
 		log.Fatalln(err)
 	}
 
@@ -61,11 +86,26 @@ func main() {
 		log.Fatalln(err)
 	}
 
+	warnings := append(data.shadowed(), data.seedsFirst()...)
+	for _, v := range warnings {
+		log.Println("warning:", v)
+	}
+	if *fWerror && len(warnings) > 0 {
+		log.Fatalln("warnings are errors with -Werror")
+	}
+
 	if *fPrint {
 		fmt.Println(data.PrintGrammar())
 		return
 	}
 
+	if *fAnalyze {
+		fmt.Print(data.Analyze())
+		return
+	}
+
+	data.emit()
+
 	var h string
 	if *fToken {
 		h = strings.ReplaceAll(strings.ReplaceAll(headerTokenMode, PREFIX, *fPrefix), ENTRYPOINT, data.entryPoint)
@@ -75,12 +115,13 @@ func main() {
 
 	// if the top level production has a type, then we have the parser return it
 	if ftype, ok := data.typeMap[data.entryPoint]; ok {
-		data.out.WriteString(fmt.Sprintf(h, "("+ftype+", error)", "ret, err", "return ret, err", "return ret, err"))
+		data.out.WriteString(fmt.Sprintf(h, "(ret "+ftype+", err error)", "ret, err", "return ret, err"))
 	} else {
-		data.out.WriteString(fmt.Sprintf(h, "error", "err", "return err", "return err"))
+		data.out.WriteString(fmt.Sprintf(h, "(err error)", "err", "return err"))
 	}
 
 	data.out.WriteString(strings.ReplaceAll(errorRecovery, PREFIX, *fPrefix))
+	data.out.WriteString(strings.ReplaceAll(memoization, PREFIX, *fPrefix))
 
 	formatted, err := format.Source([]byte(data.out.String()))
 	if err != nil {
@@ -4,7 +4,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -19,76 +18,115 @@ type Repetition *GOR
 type Option *GOR
 type Group *GOR
 type Term *Term
+type Operand *Term
 type Alternative *Alternative
 type Expression *Expression
 type CodeBlock string
-type Error string
-type Action string
+type Error *ErrorBlock
+type Action *ActionBlock
+type InlineAction *ActionBlock
+type Recover []string
+type Head *productionHead
+type Precedence []*precedenceLevel
+type Associativity *precedenceLevel
 type Name string
+type Label string
+type Binding string
+type Parameters []string
+type Arguments []string
 type QuotedString string
 
 # The top level production is the initial state to attempt to reduce.
 
 Program     = { Comment } [ Header ] { Types } Line { Line } .
 Header      = CodeBlock .							Action { p.out.WriteString(doNotModify); p.out.WriteString(v1) }
-Types       = "type" Name lex(type) .						Action {
-											if _, ok := p.typeMap[v2]; ok {
-												log.Fatalf("type %v redeclared", v2)
+Types       = "type" Name [ Parameters ] lex(type) .				Action {
+											if _, ok := p.typeMap[v2]; ok || p.macroTypes[v2] != nil {
+												p.Fail(ctx.Start, fmt.Errorf("type %v redeclared", v2))
+											}
+											if v3 != nil {
+												p.macroTypes[v2] = &macroType{params: v3, typ: v4}
+											} else {
+												p.typeMap[v2] = v4
 											}
-											p.typeMap[v2] = v3
 										}
 Line        = Comment | Production .
-Production  = Name "=" [ Expression ] "." [ Action ] [ Error ] .		Action { 
-											if p.stateMap[v1] != nil {
-												log.Fatalf("%v redeclared", v1)
+Production  = Head [ Precedence ] [ Action ] [ Error ] [ Recover ] .		Action {
+											// a head with an error was recovered from,
+											// and the error has been recorded.
+											if v1 == nil {
+												return
+											}
+											if p.stateMap[v1.name] != nil || p.macros[v1.name] != nil {
+												p.Fail(ctx.Start, fmt.Errorf("%v redeclared", v1.name))
+											}
+											params, inherited, err := parseParameters(v1.params)
+											if err != nil {
+												p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
+											}
+											if v1.exp != nil {
+												if err := p.checkBindings(v1.exp, inherited); err != nil {
+													p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
+												}
+												if err := checkActions(v1.exp, v3); err != nil {
+													p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
+												}
 											}
-											p.stateMap[v1] = v3
-											p.orderedStates = append(p.orderedStates, v1)
-											
-											p.emitState(v1, v3, v5, v6)
 
-											if p.entryPoint == "" {
-												p.entryPoint = v1
+											prod := &Production{
+												name:       v1.name,
+												params:     params,
+												inherited:  inherited,
+												exp:        v1.exp,
+												action:     v3,
+												errorBlock: v4,
+												sync:       v5,
+												precedence: v2,
 											}
+											if v2 != nil {
+												if err := p.checkPrecedence(prod); err != nil {
+													p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
+												}
+											}
+											if v1.memo {
+												if inherited != nil {
+													p.Fail(ctx.Start, fmt.Errorf("%v: a production with runtime parameters cannot be memoized", v1.name))
+												}
+												prod.memo = true
+											}
+											p.addProduction(prod)
 										}
-Action      = "Action" CodeBlock .						Action { return v2; }
-Error       = "Error" CodeBlock .						Action { return v2; }
+Head        = Name [ Parameters ] [ "@memo" ] "=" [ Expression ] "." .		Action { return &productionHead{name: v1, params: v2, memo: v3 != "", exp: v5}; } Recover { "." }
+Precedence  = Associativity { Associativity } .					Action { return append([]*precedenceLevel{v1}, v2...); }
+Associativity = ( "%left" | "%right" ) Literal { Literal } .			Action { return &precedenceLevel{right: a1Pos == 2, operators: append([]string{v3}, v4...)}; }
+Action      = "Action" [ "fallible" ] CodeBlock .				Action { return &ActionBlock{code: v3, fallible: v2 != ""}; }
+InlineAction = "=>" [ "fallible" ] CodeBlock .					Action { return &ActionBlock{code: v3, fallible: v2 != ""}; }
+Error       = "Error" [ "recover" ] CodeBlock .					Action { return &ErrorBlock{code: v3, recover: v2 != ""}; }
+Recover     = "Recover" "{" Literal { Literal } "}" .				Action { return append([]string{v3}, v4...); }
 CodeBlock   = "{" Code "}" .							Action { return v2; }
 Expression  = Alternative { "|" Alternative } .					Action { return &Expression{ alternatives: append([]*Alternative{v1}, v3...)}; }
-Alternative = Term { Term } .							Action { return &Alternative{terms: append([]*Term{v1}, v2...)}; }
-Term        = Lex | Name | Literal | Group | Option | Repetition .		Action { 
-											t := &Term{}
-											switch a1Pos {
-												case 1:
-													t.lex = v1	
-													t.option = TERM_LEX
-												case 2:
-													t.name = v2
-													t.option = TERM_NAME
-												case 3:
-													t.literal = v3
-													t.option = TERM_LITERAL
-												case 4:
-													t.gor = v4
-													t.option = TERM_GOR
-												case 5:
-													t.gor = v5
-													t.option = TERM_GOR
-												case 6: 
-													t.gor = v6
-													t.option = TERM_GOR
-											}
-											return t
-										}
+Alternative = Term { Term } .							Action { return newAlternative(append([]*Term{v1}, v2...)); }
+Term        = InlineAction							=> { return &Term{option: TERM_ACTION, action: v1}; }
+	    | [ Binding ] Operand [ Label ]					=> { v2.binding = v1; v2.label = v3; return v2; } .
+Operand     = Lex								=> { return &Term{option: TERM_LEX, lex: v1}; }
+	    | Name [ Arguments ]						=> { return &Term{option: TERM_NAME, name: v1, args: v2}; }
+	    | Literal								=> { return &Term{option: TERM_LITERAL, literal: v1}; }
+	    | Group								=> { return &Term{option: TERM_GOR, gor: v1}; }
+	    | Option								=> { return &Term{option: TERM_GOR, gor: v1}; }
+	    | Repetition							=> { return &Term{option: TERM_GOR, gor: v1}; } .
 Group       = "(" Expression ")" .						Action { return &GOR{ option: GOR_GROUP, expression: v2}; }
 Option      = "[" Expression "]" .						Action { return &GOR{ option: GOR_OPTION, expression: v2}; }
 Repetition  = "{" Expression "}" .						Action { return &GOR{ option: GOR_REPETITION, expression: v2}; }
 Lex         = "lex" "(" lex(functionname) ")" .					Action { return v3; }
 Literal     = "\"" QuotedString "\"" .						Action { return v2; }
+Label       = "@" Literal .							Action { return v2; }
+Binding     = Name ":" .							Action { return v1; }
+Parameters  = lex(parameters) .						Action { return splitList(v1); }
+Arguments   = lex(arguments) .							Action { return splitList(v1); }
 Name	    = lex(name) .							Action { return v1; }
 
 # Lexer directives. 
 
 Code        	= lex(code) .							Action { return v1; }
 QuotedString    = lex(quotedstring) .						Action { return v1; }
-Comment     	= "#" lex(comment) .						Action { p.out.WriteString("// " + v2 + "\n") }
+Comment     	= "#" lex(comment) .						Action { p.lines = append(p.lines, line{comment: v2}) }
@@ -5,7 +5,6 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -16,17 +15,20 @@ import (
 // Program = { Comment } [ Header ] { Types } Line { Line }
 func (p *pbpgParser) stateProgram() error {
 	var err error
+	entryPos := p.pos
+	p.productions = append(p.productions, "Program")
 	// repetition
 	for {
 		p = p.predict()
+		repPos := p.pos
 		v1ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		err = p.stateComment()
 		if p.errorStack.coalesce() != nil {
 			v1ErrorStack.merge(p.errorStack)
 		}
 		p.errorStack = v1ErrorStack
-		if err != nil {
+		if err != nil || p.pos == repPos {
 			p = p.backtrack()
 			err = nil
 			break
@@ -38,7 +40,7 @@ func (p *pbpgParser) stateProgram() error {
 		// option
 		p = p.predict()
 		v1ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		err = p.stateHeader()
 		if p.errorStack.coalesce() != nil {
 			v1ErrorStack.merge(p.errorStack)
@@ -54,14 +56,15 @@ func (p *pbpgParser) stateProgram() error {
 			// repetition
 			for {
 				p = p.predict()
+				repPos := p.pos
 				v1ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
+				p.errorStack = p.errorStack.fresh()
 				err = p.stateTypes()
 				if p.errorStack.coalesce() != nil {
 					v1ErrorStack.merge(p.errorStack)
 				}
 				p.errorStack = v1ErrorStack
-				if err != nil {
+				if err != nil || p.pos == repPos {
 					p = p.backtrack()
 					err = nil
 					break
@@ -71,7 +74,7 @@ func (p *pbpgParser) stateProgram() error {
 			}
 			if err == nil {
 				v1ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
+				p.errorStack = p.errorStack.fresh()
 				err = p.stateLine()
 				if p.errorStack.coalesce() != nil {
 					v1ErrorStack.merge(p.errorStack)
@@ -81,14 +84,15 @@ func (p *pbpgParser) stateProgram() error {
 					// repetition
 					for {
 						p = p.predict()
+						repPos := p.pos
 						v1ErrorStack := p.errorStack
-						p.errorStack = &parserErrorStack{}
+						p.errorStack = p.errorStack.fresh()
 						err = p.stateLine()
 						if p.errorStack.coalesce() != nil {
 							v1ErrorStack.merge(p.errorStack)
 						}
 						p.errorStack = v1ErrorStack
-						if err != nil {
+						if err != nil || p.pos == repPos {
 							p = p.backtrack()
 							err = nil
 							break
@@ -100,130 +104,200 @@ func (p *pbpgParser) stateProgram() error {
 			}
 		}
 	}
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
 // Header = CodeBlock
 func (p *pbpgParser) stateHeader() error {
 	var err error
+	entryPos := p.pos
 	var v1 string
+	p.productions = append(p.productions, "Header")
 	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
+	p.errorStack = p.errorStack.fresh()
 	v1, err = p.stateCodeBlock()
 	if p.errorStack.coalesce() != nil {
 		v1ErrorStack.merge(p.errorStack)
 	}
 	p.errorStack = v1ErrorStack
 	if err == nil {
-		p.Data.actionHeader(p.pos, v1)
+		ctx := p.context(entryPos, "Header")
+		pos := p.pos
+		p.queue(func() { p.Data.actionHeader(pos, ctx, v1) })
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
-func (p *pbpgData) actionHeader(pos int, v1 string) {
+func (p *pbpgData) actionHeader(pos int, ctx pbpgContext, v1 string) {
 	p.out.WriteString(doNotModify)
 	p.out.WriteString(v1)
 }
 
-// Types = "type" Name type
+// Types = "type" Name [ Parameters ] type
 func (p *pbpgParser) stateTypes() error {
 	var err error
+	entryPos := p.pos
 	var v1 string
 	var v2 string
-	var v3 string
+	var v3 []string
+	var v4 string
+	p.productions = append(p.productions, "Types")
 	v1, err = p.literal("type")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"type\"")
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateName()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
 		}
 		p.errorStack = v2ErrorStack
 		if err == nil {
-			{
-				n, lexeme, lerr := p.Data.lextype(p.input[p.pos:])
-				p.pos += n
-				if lerr != nil {
-					err = lerr
-				} else {
-					err = nil
-					v3 = lexeme
-				}
+			// option
+			p = p.predict()
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateParameters()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
 			}
+			p.errorStack = v3ErrorStack
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p = p.backtrack()
+				err = nil
+			} else {
+				p = p.accept()
+			}
+			if err == nil {
+				{
+					n, lexeme, lerr := p.Data.lextype(p.input[p.pos:])
+					if lerr != nil {
+						err = lerr
+					} else {
+						err = nil
+						p.pos += n
+						v4 = lexeme
+					}
+				}
+				if err != nil {
+					p.errorStack.expect(err, p.errorPos(err), p.productions, "type")
+				}
 			}
 		}
 	}
 	if err == nil {
-		p.Data.actionTypes(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Types")
+		pos := p.pos
+		p.queue(func() { p.Data.actionTypes(pos, ctx, v1, v2, v3, v4) })
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
-func (p *pbpgData) actionTypes(pos int, v1 string, v2 string, v3 string) {
-	if _, ok := p.typeMap[v2]; ok {
-		log.Fatalf("type %v redeclared", v2)
+func (p *pbpgData) actionTypes(pos int, ctx pbpgContext, v1 string, v2 string, v3 []string, v4 string) {
+	if _, ok := p.typeMap[v2]; ok || p.macroTypes[v2] != nil {
+		p.Fail(ctx.Start, fmt.Errorf("type %v redeclared", v2))
+	}
+	if v3 != nil {
+		p.macroTypes[v2] = &macroType{params: v3, typ: v4}
+	} else {
+		p.typeMap[v2] = v4
 	}
-	p.typeMap[v2] = v3
 
 }
 
 // Line = Comment | Production
 func (p *pbpgParser) stateLine() error {
 	var err error
+	entryPos := p.pos
+	p.productions = append(p.productions, "Line")
+	p = p.predict()
 	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
+	p.errorStack = p.errorStack.fresh()
 	err = p.stateComment()
 	if p.errorStack.coalesce() != nil {
 		v1ErrorStack.merge(p.errorStack)
 	}
 	p.errorStack = v1ErrorStack
+	if err != nil {
+		p = p.backtrack()
+	} else {
+		p = p.accept()
+	}
 	if err != nil {
 		v1ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		err = p.stateProduction()
 		if p.errorStack.coalesce() != nil {
 			v1ErrorStack.merge(p.errorStack)
 		}
 		p.errorStack = v1ErrorStack
 	}
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
-// Production = Name "=" [ Expression ] "." [ Action ] [ Error ]
+// Production = Head [ Precedence ] [ Action ] [ Error ] [ Recover ]
 func (p *pbpgParser) stateProduction() error {
 	var err error
-	var v1 string
-	var v2 string
-	var v3 *Expression
-	var v4 string
-	var v5 string
-	var v6 string
+	entryPos := p.pos
+	var v1 *productionHead
+	var v2 []*precedenceLevel
+	var v3 *ActionBlock
+	var v4 *ErrorBlock
+	var v5 []string
+	p.productions = append(p.productions, "Production")
 	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateName()
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateHead()
 	if p.errorStack.coalesce() != nil {
 		v1ErrorStack.merge(p.errorStack)
 	}
 	p.errorStack = v1ErrorStack
 	if err == nil {
-		v2, err = p.literal("=")
+		// option
+		p = p.predict()
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.statePrecedence()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
 		if err != nil {
-			p.errorStack.error(err, p.pos)
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
 		}
 		if err == nil {
 			// option
 			p = p.predict()
 			v3ErrorStack := p.errorStack
-			p.errorStack = &parserErrorStack{}
-			v3, err = p.stateExpression()
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateAction()
 			if p.errorStack.coalesce() != nil {
 				v3ErrorStack.merge(p.errorStack)
 			}
@@ -235,16 +309,27 @@ func (p *pbpgParser) stateProduction() error {
 				p = p.accept()
 			}
 			if err == nil {
-				v4, err = p.literal(".")
+				// option
+				p = p.predict()
+				v4ErrorStack := p.errorStack
+				p.errorStack = p.errorStack.fresh()
+				v4, err = p.stateError()
+				if p.errorStack.coalesce() != nil {
+					v4ErrorStack.merge(p.errorStack)
+				}
+				p.errorStack = v4ErrorStack
 				if err != nil {
-					p.errorStack.error(err, p.pos)
+					p = p.backtrack()
+					err = nil
+				} else {
+					p = p.accept()
 				}
 				if err == nil {
 					// option
 					p = p.predict()
 					v5ErrorStack := p.errorStack
-					p.errorStack = &parserErrorStack{}
-					v5, err = p.stateAction()
+					p.errorStack = p.errorStack.fresh()
+					v5, err = p.stateRecover()
 					if p.errorStack.coalesce() != nil {
 						v5ErrorStack.merge(p.errorStack)
 					}
@@ -255,211 +340,183 @@ func (p *pbpgParser) stateProduction() error {
 					} else {
 						p = p.accept()
 					}
-					if err == nil {
-						// option
-						p = p.predict()
-						v6ErrorStack := p.errorStack
-						p.errorStack = &parserErrorStack{}
-						v6, err = p.stateError()
-						if p.errorStack.coalesce() != nil {
-							v6ErrorStack.merge(p.errorStack)
-						}
-						p.errorStack = v6ErrorStack
-						if err != nil {
-							p = p.backtrack()
-							err = nil
-						} else {
-							p = p.accept()
-						}
-					}
 				}
 			}
 		}
 	}
 	if err == nil {
-		p.Data.actionProduction(p.pos, v1, v2, v3, v4, v5, v6)
+		ctx := p.context(entryPos, "Production")
+		pos := p.pos
+		p.queue(func() { p.Data.actionProduction(pos, ctx, v1, v2, v3, v4, v5) })
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
-func (p *pbpgData) actionProduction(pos int, v1 string, v2 string, v3 *Expression, v4 string, v5 string, v6 string) {
-	if p.stateMap[v1] != nil {
-		log.Fatalf("%v redeclared", v1)
+func (p *pbpgData) actionProduction(pos int, ctx pbpgContext, v1 *productionHead, v2 []*precedenceLevel, v3 *ActionBlock, v4 *ErrorBlock, v5 []string) {
+	// a head with an error was recovered from,
+	// and the error has been recorded.
+	if v1 == nil {
+		return
 	}
-	p.stateMap[v1] = v3
-	p.orderedStates = append(p.orderedStates, v1)
-
-	p.emitState(v1, v3, v5, v6)
-
-	if p.entryPoint == "" {
-		p.entryPoint = v1
+	if p.stateMap[v1.name] != nil || p.macros[v1.name] != nil {
+		p.Fail(ctx.Start, fmt.Errorf("%v redeclared", v1.name))
 	}
-
-}
-
-// Action = "Action" CodeBlock
-func (p *pbpgParser) stateAction() (string, error) {
-	var err error
-	var ret string
-	var v1 string
-	var v2 string
-	v1, err = p.literal("Action")
+	params, inherited, err := parseParameters(v1.params)
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
 	}
-	if err == nil {
-		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
-		v2, err = p.stateCodeBlock()
-		if p.errorStack.coalesce() != nil {
-			v2ErrorStack.merge(p.errorStack)
+	if v1.exp != nil {
+		if err := p.checkBindings(v1.exp, inherited); err != nil {
+			p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
+		}
+		if err := checkActions(v1.exp, v3); err != nil {
+			p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
 		}
-		p.errorStack = v2ErrorStack
-	}
-	if err == nil {
-		ret = p.Data.actionAction(p.pos, v1, v2)
 	}
 
-	return ret, err
-}
-
-func (p *pbpgData) actionAction(pos int, v1 string, v2 string) string {
-	return v2
-}
-
-// Error = "Error" CodeBlock
-func (p *pbpgParser) stateError() (string, error) {
-	var err error
-	var ret string
-	var v1 string
-	var v2 string
-	v1, err = p.literal("Error")
-	if err != nil {
-		p.errorStack.error(err, p.pos)
+	prod := &Production{
+		name:       v1.name,
+		params:     params,
+		inherited:  inherited,
+		exp:        v1.exp,
+		action:     v3,
+		errorBlock: v4,
+		sync:       v5,
+		precedence: v2,
 	}
-	if err == nil {
-		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
-		v2, err = p.stateCodeBlock()
-		if p.errorStack.coalesce() != nil {
-			v2ErrorStack.merge(p.errorStack)
+	if v2 != nil {
+		if err := p.checkPrecedence(prod); err != nil {
+			p.Fail(ctx.Start, fmt.Errorf("%v: %w", v1.name, err))
 		}
-		p.errorStack = v2ErrorStack
 	}
-	if err == nil {
-		ret = p.Data.actionError(p.pos, v1, v2)
+	if v1.memo {
+		if inherited != nil {
+			p.Fail(ctx.Start, fmt.Errorf("%v: a production with runtime parameters cannot be memoized", v1.name))
+		}
+		prod.memo = true
 	}
+	p.addProduction(prod)
 
-	return ret, err
-}
-
-func (p *pbpgData) actionError(pos int, v1 string, v2 string) string {
-	return v2
 }
 
-// CodeBlock = "{" Code "}"
-func (p *pbpgParser) stateCodeBlock() (string, error) {
+// Head = Name [ Parameters ] [ "@memo" ] "=" [ Expression ] "."
+func (p *pbpgParser) stateHead() (*productionHead, error) {
 	var err error
-	var ret string
+	entryPos := p.pos
+	var ret *productionHead
 	var v1 string
-	var v2 string
+	var v2 []string
 	var v3 string
-	v1, err = p.literal("{")
-	if err != nil {
-		p.errorStack.error(err, p.pos)
+	var v4 string
+	var v5 *Expression
+	var v6 string
+	p.productions = append(p.productions, "Head")
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateName()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
 	}
+	p.errorStack = v1ErrorStack
 	if err == nil {
+		// option
+		p = p.predict()
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
-		v2, err = p.stateCode()
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateParameters()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
 		}
 		p.errorStack = v2ErrorStack
-		if err == nil {
-			v3, err = p.literal("}")
-			if err != nil {
-				p.errorStack.error(err, p.pos)
-			}
+		if err != nil {
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
 		}
-	}
-	if err == nil {
-		ret = p.Data.actionCodeBlock(p.pos, v1, v2, v3)
-	}
-
-	return ret, err
-}
-
-func (p *pbpgData) actionCodeBlock(pos int, v1 string, v2 string, v3 string) string {
-	return v2
-}
-
-// Expression = Alternative { "|" Alternative }
-func (p *pbpgParser) stateExpression() (*Expression, error) {
-	var err error
-	var ret *Expression
-	var v1 *Alternative
-	var v2temp string
-	var v2 []string
-	var v3temp *Alternative
-	var v3 []*Alternative
-	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateAlternative()
-	if p.errorStack.coalesce() != nil {
-		v1ErrorStack.merge(p.errorStack)
-	}
-	p.errorStack = v1ErrorStack
-	if err == nil {
-		// repetition
-		for {
+		if err == nil {
+			// option
 			p = p.predict()
-			v2temp, err = p.literal("|")
+			v3, err = p.literal("@memo")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
-			}
-			if err == nil {
-				v3ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
-				v3temp, err = p.stateAlternative()
-				if p.errorStack.coalesce() != nil {
-					v3ErrorStack.merge(p.errorStack)
-				}
-				p.errorStack = v3ErrorStack
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"@memo\"")
 			}
 			if err != nil {
 				p = p.backtrack()
 				err = nil
-				break
 			} else {
-				v2 = append(v2, v2temp)
-				v3 = append(v3, v3temp)
 				p = p.accept()
 			}
+			if err == nil {
+				v4, err = p.literal("=")
+				if err != nil {
+					p.errorStack.expect(err, p.errorPos(err), p.productions, "\"=\"")
+				}
+				if err == nil {
+					// option
+					p = p.predict()
+					v5ErrorStack := p.errorStack
+					p.errorStack = p.errorStack.fresh()
+					v5, err = p.stateExpression()
+					if p.errorStack.coalesce() != nil {
+						v5ErrorStack.merge(p.errorStack)
+					}
+					p.errorStack = v5ErrorStack
+					if err != nil {
+						p = p.backtrack()
+						err = nil
+					} else {
+						p = p.accept()
+					}
+					if err == nil {
+						v6, err = p.literal(".")
+						if err != nil {
+							p.errorStack.expect(err, p.errorPos(err), p.productions, "\".\"")
+						}
+					}
+				}
+			}
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionExpression(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Head")
+		ret = p.Data.actionHead(p.pos, ctx, v1, v2, v3, v4, v5, v6)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	if err != nil && p.recover(".") {
+		err = nil
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionExpression(pos int, v1 *Alternative, v2 []string, v3 []*Alternative) *Expression {
-	return &Expression{alternatives: append([]*Alternative{v1}, v3...)}
+func (p *pbpgData) actionHead(pos int, ctx pbpgContext, v1 string, v2 []string, v3 string, v4 string, v5 *Expression, v6 string) *productionHead {
+	return &productionHead{name: v1, params: v2, memo: v3 != "", exp: v5}
 }
 
-// Alternative = Term { Term }
-func (p *pbpgParser) stateAlternative() (*Alternative, error) {
+// Precedence = Associativity { Associativity }
+func (p *pbpgParser) statePrecedence() ([]*precedenceLevel, error) {
 	var err error
-	var ret *Alternative
-	var v1 *Term
-	var v2temp *Term
-	var v2 []*Term
+	entryPos := p.pos
+	var ret []*precedenceLevel
+	var v1 *precedenceLevel
+	var v2temp *precedenceLevel
+	var v2 []*precedenceLevel
+	p.productions = append(p.productions, "Precedence")
 	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateTerm()
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateAssociativity()
 	if p.errorStack.coalesce() != nil {
 		v1ErrorStack.merge(p.errorStack)
 	}
@@ -468,14 +525,15 @@ func (p *pbpgParser) stateAlternative() (*Alternative, error) {
 		// repetition
 		for {
 			p = p.predict()
+			repPos := p.pos
 			v2ErrorStack := p.errorStack
-			p.errorStack = &parserErrorStack{}
-			v2temp, err = p.stateTerm()
+			p.errorStack = p.errorStack.fresh()
+			v2temp, err = p.stateAssociativity()
 			if p.errorStack.coalesce() != nil {
 				v2ErrorStack.merge(p.errorStack)
 			}
 			p.errorStack = v2ErrorStack
-			if err != nil {
+			if err != nil || p.pos == repPos {
 				p = p.backtrack()
 				err = nil
 				break
@@ -486,80 +544,741 @@ func (p *pbpgParser) stateAlternative() (*Alternative, error) {
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionAlternative(p.pos, v1, v2)
+		ctx := p.context(entryPos, "Precedence")
+		ret = p.Data.actionPrecedence(p.pos, ctx, v1, v2)
 	}
 
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionAlternative(pos int, v1 *Term, v2 []*Term) *Alternative {
-	return &Alternative{terms: append([]*Term{v1}, v2...)}
+func (p *pbpgData) actionPrecedence(pos int, ctx pbpgContext, v1 *precedenceLevel, v2 []*precedenceLevel) []*precedenceLevel {
+	return append([]*precedenceLevel{v1}, v2...)
 }
 
-// Term = Lex | Name | Literal | Group | Option | Repetition
-func (p *pbpgParser) stateTerm() (*Term, error) {
+// Associativity = ( "%left" | "%right" ) Literal { Literal }
+func (p *pbpgParser) stateAssociativity() (*precedenceLevel, error) {
 	var err error
-	var ret *Term
+	entryPos := p.pos
+	var ret *precedenceLevel
 	var a1Pos int
 	var v1 string
 	var v2 string
 	var v3 string
-	var v4 *GOR
-	var v5 *GOR
-	var v6 *GOR
+	var v4temp string
+	var v4 []string
+	p.productions = append(p.productions, "Associativity")
+	// group
+	p = p.predict()
 	a1Pos = 1
-	v1ErrorStack := p.errorStack
-	p.errorStack = &parserErrorStack{}
-	v1, err = p.stateLex()
-	if p.errorStack.coalesce() != nil {
-		v1ErrorStack.merge(p.errorStack)
+	v1, err = p.literal("%left")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"%left\"")
 	}
-	p.errorStack = v1ErrorStack
 	if err != nil {
 		a1Pos = 2
-		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
-		v2, err = p.stateName()
-		if p.errorStack.coalesce() != nil {
-			v2ErrorStack.merge(p.errorStack)
+		v2, err = p.literal("%right")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"%right\"")
 		}
-		p.errorStack = v2ErrorStack
 		if err != nil {
-			a1Pos = 3
+			a1Pos = -1
+		}
+	}
+	if err != nil {
+		p = p.backtrack()
+	} else {
+		p = p.accept()
+	}
+	if err == nil {
+		v3ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v3, err = p.stateLiteral()
+		if p.errorStack.coalesce() != nil {
+			v3ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v3ErrorStack
+		if err == nil {
+			// repetition
+			for {
+				p = p.predict()
+				repPos := p.pos
+				v4ErrorStack := p.errorStack
+				p.errorStack = p.errorStack.fresh()
+				v4temp, err = p.stateLiteral()
+				if p.errorStack.coalesce() != nil {
+					v4ErrorStack.merge(p.errorStack)
+				}
+				p.errorStack = v4ErrorStack
+				if err != nil || p.pos == repPos {
+					p = p.backtrack()
+					err = nil
+					break
+				} else {
+					v4 = append(v4, v4temp)
+					p = p.accept()
+				}
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Associativity")
+		ret = p.Data.actionAssociativity(p.pos, ctx, a1Pos, v1, v2, v3, v4)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionAssociativity(pos int, ctx pbpgContext, a1Pos int, v1 string, v2 string, v3 string, v4 []string) *precedenceLevel {
+	return &precedenceLevel{right: a1Pos == 2, operators: append([]string{v3}, v4...)}
+}
+
+// Action = "Action" [ "fallible" ] CodeBlock
+func (p *pbpgParser) stateAction() (*ActionBlock, error) {
+	var err error
+	entryPos := p.pos
+	var ret *ActionBlock
+	var v1 string
+	var v2 string
+	var v3 string
+	p.productions = append(p.productions, "Action")
+	v1, err = p.literal("Action")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"Action\"")
+	}
+	if err == nil {
+		// option
+		p = p.predict()
+		v2, err = p.literal("fallible")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"fallible\"")
+		}
+		if err != nil {
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
+		}
+		if err == nil {
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateCodeBlock()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v3ErrorStack
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Action")
+		ret = p.Data.actionAction(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionAction(pos int, ctx pbpgContext, v1 string, v2 string, v3 string) *ActionBlock {
+	return &ActionBlock{code: v3, fallible: v2 != ""}
+}
+
+// InlineAction = "=>" [ "fallible" ] CodeBlock
+func (p *pbpgParser) stateInlineAction() (*ActionBlock, error) {
+	var err error
+	entryPos := p.pos
+	var ret *ActionBlock
+	var v1 string
+	var v2 string
+	var v3 string
+	p.productions = append(p.productions, "InlineAction")
+	v1, err = p.literal("=>")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"=>\"")
+	}
+	if err == nil {
+		// option
+		p = p.predict()
+		v2, err = p.literal("fallible")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"fallible\"")
+		}
+		if err != nil {
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
+		}
+		if err == nil {
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateCodeBlock()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v3ErrorStack
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "InlineAction")
+		ret = p.Data.actionInlineAction(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionInlineAction(pos int, ctx pbpgContext, v1 string, v2 string, v3 string) *ActionBlock {
+	return &ActionBlock{code: v3, fallible: v2 != ""}
+}
+
+// Error = "Error" [ "recover" ] CodeBlock
+func (p *pbpgParser) stateError() (*ErrorBlock, error) {
+	var err error
+	entryPos := p.pos
+	var ret *ErrorBlock
+	var v1 string
+	var v2 string
+	var v3 string
+	p.productions = append(p.productions, "Error")
+	v1, err = p.literal("Error")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"Error\"")
+	}
+	if err == nil {
+		// option
+		p = p.predict()
+		v2, err = p.literal("recover")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"recover\"")
+		}
+		if err != nil {
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
+		}
+		if err == nil {
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateCodeBlock()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v3ErrorStack
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Error")
+		ret = p.Data.actionError(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionError(pos int, ctx pbpgContext, v1 string, v2 string, v3 string) *ErrorBlock {
+	return &ErrorBlock{code: v3, recover: v2 != ""}
+}
+
+// Recover = "Recover" "{" Literal { Literal } "}"
+func (p *pbpgParser) stateRecover() ([]string, error) {
+	var err error
+	entryPos := p.pos
+	var ret []string
+	var v1 string
+	var v2 string
+	var v3 string
+	var v4temp string
+	var v4 []string
+	var v5 string
+	p.productions = append(p.productions, "Recover")
+	v1, err = p.literal("Recover")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"Recover\"")
+	}
+	if err == nil {
+		v2, err = p.literal("{")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"{\"")
+		}
+		if err == nil {
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateLiteral()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v3ErrorStack
+			if err == nil {
+				// repetition
+				for {
+					p = p.predict()
+					repPos := p.pos
+					v4ErrorStack := p.errorStack
+					p.errorStack = p.errorStack.fresh()
+					v4temp, err = p.stateLiteral()
+					if p.errorStack.coalesce() != nil {
+						v4ErrorStack.merge(p.errorStack)
+					}
+					p.errorStack = v4ErrorStack
+					if err != nil || p.pos == repPos {
+						p = p.backtrack()
+						err = nil
+						break
+					} else {
+						v4 = append(v4, v4temp)
+						p = p.accept()
+					}
+				}
+				if err == nil {
+					v5, err = p.literal("}")
+					if err != nil {
+						p.errorStack.expect(err, p.errorPos(err), p.productions, "\"}\"")
+					}
+				}
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Recover")
+		ret = p.Data.actionRecover(p.pos, ctx, v1, v2, v3, v4, v5)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionRecover(pos int, ctx pbpgContext, v1 string, v2 string, v3 string, v4 []string, v5 string) []string {
+	return append([]string{v3}, v4...)
+}
+
+// CodeBlock = "{" Code "}"
+func (p *pbpgParser) stateCodeBlock() (string, error) {
+	var err error
+	entryPos := p.pos
+	var ret string
+	var v1 string
+	var v2 string
+	var v3 string
+	p.productions = append(p.productions, "CodeBlock")
+	v1, err = p.literal("{")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"{\"")
+	}
+	if err == nil {
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateCode()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
+		if err == nil {
+			v3, err = p.literal("}")
+			if err != nil {
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"}\"")
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "CodeBlock")
+		ret = p.Data.actionCodeBlock(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionCodeBlock(pos int, ctx pbpgContext, v1 string, v2 string, v3 string) string {
+	return v2
+}
+
+// Expression = Alternative { "|" Alternative }
+func (p *pbpgParser) stateExpression() (*Expression, error) {
+	var err error
+	entryPos := p.pos
+	var ret *Expression
+	var v1 *Alternative
+	var v2temp string
+	var v2 []string
+	var v3temp *Alternative
+	var v3 []*Alternative
+	p.productions = append(p.productions, "Expression")
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateAlternative()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
+	}
+	p.errorStack = v1ErrorStack
+	if err == nil {
+		// repetition
+		for {
+			p = p.predict()
+			repPos := p.pos
+			v2temp, err = p.literal("|")
+			if err != nil {
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"|\"")
+			}
+			if err == nil {
+				v3ErrorStack := p.errorStack
+				p.errorStack = p.errorStack.fresh()
+				v3temp, err = p.stateAlternative()
+				if p.errorStack.coalesce() != nil {
+					v3ErrorStack.merge(p.errorStack)
+				}
+				p.errorStack = v3ErrorStack
+			}
+			if err != nil || p.pos == repPos {
+				p = p.backtrack()
+				err = nil
+				break
+			} else {
+				v2 = append(v2, v2temp)
+				v3 = append(v3, v3temp)
+				p = p.accept()
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Expression")
+		ret = p.Data.actionExpression(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionExpression(pos int, ctx pbpgContext, v1 *Alternative, v2 []string, v3 []*Alternative) *Expression {
+	return &Expression{alternatives: append([]*Alternative{v1}, v3...)}
+}
+
+// Alternative = Term { Term }
+func (p *pbpgParser) stateAlternative() (*Alternative, error) {
+	var err error
+	entryPos := p.pos
+	var ret *Alternative
+	var v1 *Term
+	var v2temp *Term
+	var v2 []*Term
+	p.productions = append(p.productions, "Alternative")
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateTerm()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
+	}
+	p.errorStack = v1ErrorStack
+	if err == nil {
+		// repetition
+		for {
+			p = p.predict()
+			repPos := p.pos
+			v2ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v2temp, err = p.stateTerm()
+			if p.errorStack.coalesce() != nil {
+				v2ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v2ErrorStack
+			if err != nil || p.pos == repPos {
+				p = p.backtrack()
+				err = nil
+				break
+			} else {
+				v2 = append(v2, v2temp)
+				p = p.accept()
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Alternative")
+		ret = p.Data.actionAlternative(p.pos, ctx, v1, v2)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionAlternative(pos int, ctx pbpgContext, v1 *Term, v2 []*Term) *Alternative {
+	return newAlternative(append([]*Term{v1}, v2...))
+}
+
+// Term = InlineAction | [ Binding ] Operand [ Label ]
+func (p *pbpgParser) stateTerm() (*Term, error) {
+	var err error
+	entryPos := p.pos
+	var ret *Term
+	var a1Pos int
+	var v1 *ActionBlock
+	var v2 string
+	var v3 *Term
+	var v4 string
+	_ = a1Pos
+	p.productions = append(p.productions, "Term")
+	a1Pos = 1
+	p = p.predict()
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateInlineAction()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
+	}
+	p.errorStack = v1ErrorStack
+	if err == nil {
+		ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+		ret = p.Data.actionTerm_1(p.pos, ctx, v1)
+	}
+	if err != nil {
+		p = p.backtrack()
+	} else {
+		p = p.accept()
+	}
+	if err != nil {
+		a1Pos = 2
+		// option
+		p = p.predict()
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateBinding()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
+		if err != nil {
+			p = p.backtrack()
+			err = nil
+		} else {
+			p = p.accept()
+		}
+		if err == nil {
 			v3ErrorStack := p.errorStack
-			p.errorStack = &parserErrorStack{}
-			v3, err = p.stateLiteral()
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateOperand()
 			if p.errorStack.coalesce() != nil {
 				v3ErrorStack.merge(p.errorStack)
 			}
 			p.errorStack = v3ErrorStack
-			if err != nil {
-				a1Pos = 4
+			if err == nil {
+				// option
+				p = p.predict()
 				v4ErrorStack := p.errorStack
-				p.errorStack = &parserErrorStack{}
-				v4, err = p.stateGroup()
+				p.errorStack = p.errorStack.fresh()
+				v4, err = p.stateLabel()
 				if p.errorStack.coalesce() != nil {
 					v4ErrorStack.merge(p.errorStack)
 				}
 				p.errorStack = v4ErrorStack
+				if err != nil {
+					p = p.backtrack()
+					err = nil
+				} else {
+					p = p.accept()
+				}
+			}
+		}
+		if err == nil {
+			ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+			ret = p.Data.actionTerm_2(p.pos, ctx, v2, v3, v4)
+		}
+		if err != nil {
+			a1Pos = -1
+		}
+	}
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionTerm_1(pos int, ctx pbpgContext, v1 *ActionBlock) *Term {
+	return &Term{option: TERM_ACTION, action: v1}
+}
+
+func (p *pbpgData) actionTerm_2(pos int, ctx pbpgContext, v1 string, v2 *Term, v3 string) *Term {
+	v2.binding = v1
+	v2.label = v3
+	return v2
+}
+
+// Operand = Lex | Name [ Arguments ] | Literal | Group | Option | Repetition
+func (p *pbpgParser) stateOperand() (*Term, error) {
+	var err error
+	entryPos := p.pos
+	var ret *Term
+	var a1Pos int
+	var v1 string
+	var v2 string
+	var v3 []string
+	var v4 string
+	var v5 *GOR
+	var v6 *GOR
+	var v7 *GOR
+	_ = a1Pos
+	p.productions = append(p.productions, "Operand")
+	a1Pos = 1
+	p = p.predict()
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateLex()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
+	}
+	p.errorStack = v1ErrorStack
+	if err == nil {
+		ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+		ret = p.Data.actionOperand_1(p.pos, ctx, v1)
+	}
+	if err != nil {
+		p = p.backtrack()
+	} else {
+		p = p.accept()
+	}
+	if err != nil {
+		a1Pos = 2
+		p = p.predict()
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateName()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
+		if err == nil {
+			// option
+			p = p.predict()
+			v3ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v3, err = p.stateArguments()
+			if p.errorStack.coalesce() != nil {
+				v3ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v3ErrorStack
+			if err != nil {
+				p = p.backtrack()
+				err = nil
+			} else {
+				p = p.accept()
+			}
+		}
+		if err == nil {
+			ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+			ret = p.Data.actionOperand_2(p.pos, ctx, v2, v3)
+		}
+		if err != nil {
+			p = p.backtrack()
+		} else {
+			p = p.accept()
+		}
+		if err != nil {
+			a1Pos = 3
+			p = p.predict()
+			v4ErrorStack := p.errorStack
+			p.errorStack = p.errorStack.fresh()
+			v4, err = p.stateLiteral()
+			if p.errorStack.coalesce() != nil {
+				v4ErrorStack.merge(p.errorStack)
+			}
+			p.errorStack = v4ErrorStack
+			if err == nil {
+				ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+				ret = p.Data.actionOperand_3(p.pos, ctx, v4)
+			}
+			if err != nil {
+				p = p.backtrack()
+			} else {
+				p = p.accept()
+			}
+			if err != nil {
+				a1Pos = 4
+				p = p.predict()
+				v5ErrorStack := p.errorStack
+				p.errorStack = p.errorStack.fresh()
+				v5, err = p.stateGroup()
+				if p.errorStack.coalesce() != nil {
+					v5ErrorStack.merge(p.errorStack)
+				}
+				p.errorStack = v5ErrorStack
+				if err == nil {
+					ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+					ret = p.Data.actionOperand_4(p.pos, ctx, v5)
+				}
+				if err != nil {
+					p = p.backtrack()
+				} else {
+					p = p.accept()
+				}
 				if err != nil {
 					a1Pos = 5
-					v5ErrorStack := p.errorStack
-					p.errorStack = &parserErrorStack{}
-					v5, err = p.stateOption()
+					p = p.predict()
+					v6ErrorStack := p.errorStack
+					p.errorStack = p.errorStack.fresh()
+					v6, err = p.stateOption()
 					if p.errorStack.coalesce() != nil {
-						v5ErrorStack.merge(p.errorStack)
+						v6ErrorStack.merge(p.errorStack)
+					}
+					p.errorStack = v6ErrorStack
+					if err == nil {
+						ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+						ret = p.Data.actionOperand_5(p.pos, ctx, v6)
+					}
+					if err != nil {
+						p = p.backtrack()
+					} else {
+						p = p.accept()
 					}
-					p.errorStack = v5ErrorStack
 					if err != nil {
 						a1Pos = 6
-						v6ErrorStack := p.errorStack
-						p.errorStack = &parserErrorStack{}
-						v6, err = p.stateRepetition()
+						v7ErrorStack := p.errorStack
+						p.errorStack = p.errorStack.fresh()
+						v7, err = p.stateRepetition()
 						if p.errorStack.coalesce() != nil {
-							v6ErrorStack.merge(p.errorStack)
+							v7ErrorStack.merge(p.errorStack)
+						}
+						p.errorStack = v7ErrorStack
+						if err == nil {
+							ctx := p.context(entryPos, p.productions[len(p.productions)-1])
+							ret = p.Data.actionOperand_6(p.pos, ctx, v7)
 						}
-						p.errorStack = v6ErrorStack
 						if err != nil {
 							a1Pos = -1
 						}
@@ -568,53 +1287,54 @@ func (p *pbpgParser) stateTerm() (*Term, error) {
 			}
 		}
 	}
-	if err == nil {
-		ret = p.Data.actionTerm(p.pos, a1Pos, v1, v2, v3, v4, v5, v6)
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionTerm(pos int, a1Pos int, v1 string, v2 string, v3 string, v4 *GOR, v5 *GOR, v6 *GOR) *Term {
-	t := &Term{}
-	switch a1Pos {
-	case 1:
-		t.lex = v1
-		t.option = TERM_LEX
-	case 2:
-		t.name = v2
-		t.option = TERM_NAME
-	case 3:
-		t.literal = v3
-		t.option = TERM_LITERAL
-	case 4:
-		t.gor = v4
-		t.option = TERM_GOR
-	case 5:
-		t.gor = v5
-		t.option = TERM_GOR
-	case 6:
-		t.gor = v6
-		t.option = TERM_GOR
-	}
-	return t
+func (p *pbpgData) actionOperand_1(pos int, ctx pbpgContext, v1 string) *Term {
+	return &Term{option: TERM_LEX, lex: v1}
+}
+
+func (p *pbpgData) actionOperand_2(pos int, ctx pbpgContext, v1 string, v2 []string) *Term {
+	return &Term{option: TERM_NAME, name: v1, args: v2}
+}
+
+func (p *pbpgData) actionOperand_3(pos int, ctx pbpgContext, v1 string) *Term {
+	return &Term{option: TERM_LITERAL, literal: v1}
+}
+
+func (p *pbpgData) actionOperand_4(pos int, ctx pbpgContext, v1 *GOR) *Term {
+	return &Term{option: TERM_GOR, gor: v1}
+}
+
+func (p *pbpgData) actionOperand_5(pos int, ctx pbpgContext, v1 *GOR) *Term {
+	return &Term{option: TERM_GOR, gor: v1}
+}
 
+func (p *pbpgData) actionOperand_6(pos int, ctx pbpgContext, v1 *GOR) *Term {
+	return &Term{option: TERM_GOR, gor: v1}
 }
 
 // Group = "(" Expression ")"
 func (p *pbpgParser) stateGroup() (*GOR, error) {
 	var err error
+	entryPos := p.pos
 	var ret *GOR
 	var v1 string
 	var v2 *Expression
 	var v3 string
+	p.productions = append(p.productions, "Group")
 	v1, err = p.literal("(")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"(\"")
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateExpression()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
@@ -623,35 +1343,43 @@ func (p *pbpgParser) stateGroup() (*GOR, error) {
 		if err == nil {
 			v3, err = p.literal(")")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\")\"")
 			}
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionGroup(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Group")
+		ret = p.Data.actionGroup(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionGroup(pos int, v1 string, v2 *Expression, v3 string) *GOR {
+func (p *pbpgData) actionGroup(pos int, ctx pbpgContext, v1 string, v2 *Expression, v3 string) *GOR {
 	return &GOR{option: GOR_GROUP, expression: v2}
 }
 
 // Option = "[" Expression "]"
 func (p *pbpgParser) stateOption() (*GOR, error) {
 	var err error
+	entryPos := p.pos
 	var ret *GOR
 	var v1 string
 	var v2 *Expression
 	var v3 string
+	p.productions = append(p.productions, "Option")
 	v1, err = p.literal("[")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"[\"")
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateExpression()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
@@ -660,35 +1388,43 @@ func (p *pbpgParser) stateOption() (*GOR, error) {
 		if err == nil {
 			v3, err = p.literal("]")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"]\"")
 			}
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionOption(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Option")
+		ret = p.Data.actionOption(p.pos, ctx, v1, v2, v3)
 	}
 
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionOption(pos int, v1 string, v2 *Expression, v3 string) *GOR {
+func (p *pbpgData) actionOption(pos int, ctx pbpgContext, v1 string, v2 *Expression, v3 string) *GOR {
 	return &GOR{option: GOR_OPTION, expression: v2}
 }
 
 // Repetition = "{" Expression "}"
 func (p *pbpgParser) stateRepetition() (*GOR, error) {
 	var err error
+	entryPos := p.pos
 	var ret *GOR
 	var v1 string
 	var v2 *Expression
 	var v3 string
+	p.productions = append(p.productions, "Repetition")
 	v1, err = p.literal("{")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"{\"")
 	}
 	if err == nil {
 		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
+		p.errorStack = p.errorStack.fresh()
 		v2, err = p.stateExpression()
 		if p.errorStack.coalesce() != nil {
 			v2ErrorStack.merge(p.errorStack)
@@ -697,134 +1433,314 @@ func (p *pbpgParser) stateRepetition() (*GOR, error) {
 		if err == nil {
 			v3, err = p.literal("}")
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"}\"")
 			}
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionRepetition(p.pos, v1, v2, v3)
+		ctx := p.context(entryPos, "Repetition")
+		ret = p.Data.actionRepetition(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionRepetition(pos int, v1 string, v2 *Expression, v3 string) *GOR {
+func (p *pbpgData) actionRepetition(pos int, ctx pbpgContext, v1 string, v2 *Expression, v3 string) *GOR {
 	return &GOR{option: GOR_REPETITION, expression: v2}
 }
 
 // Lex = "lex" "(" functionname ")"
 func (p *pbpgParser) stateLex() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
 	var v2 string
 	var v3 string
 	var v4 string
+	p.productions = append(p.productions, "Lex")
 	v1, err = p.literal("lex")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"lex\"")
 	}
 	if err == nil {
 		v2, err = p.literal("(")
 		if err != nil {
-			p.errorStack.error(err, p.pos)
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\"(\"")
 		}
 		if err == nil {
 			{
 				n, lexeme, lerr := p.Data.lexfunctionname(p.input[p.pos:])
-				p.pos += n
 				if lerr != nil {
 					err = lerr
 				} else {
 					err = nil
+					p.pos += n
 					v3 = lexeme
 				}
 			}
 			if err != nil {
-				p.errorStack.error(err, p.pos)
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "functionname")
 			}
 			if err == nil {
 				v4, err = p.literal(")")
 				if err != nil {
-					p.errorStack.error(err, p.pos)
+					p.errorStack.expect(err, p.errorPos(err), p.productions, "\")\"")
 				}
 			}
 		}
 	}
 	if err == nil {
-		ret = p.Data.actionLex(p.pos, v1, v2, v3, v4)
+		ctx := p.context(entryPos, "Lex")
+		ret = p.Data.actionLex(p.pos, ctx, v1, v2, v3, v4)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionLex(pos int, v1 string, v2 string, v3 string, v4 string) string {
+func (p *pbpgData) actionLex(pos int, ctx pbpgContext, v1 string, v2 string, v3 string, v4 string) string {
 	return v3
 }
 
 // Literal = """ QuotedString """
 func (p *pbpgParser) stateLiteral() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
 	var v2 string
 	var v3 string
+	p.productions = append(p.productions, "Literal")
 	v1, err = p.literal("\"")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"\\\"\"")
+	}
+	if err == nil {
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateQuotedString()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
+		if err == nil {
+			v3, err = p.literal("\"")
+			if err != nil {
+				p.errorStack.expect(err, p.errorPos(err), p.productions, "\"\\\"\"")
+			}
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Literal")
+		ret = p.Data.actionLiteral(p.pos, ctx, v1, v2, v3)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionLiteral(pos int, ctx pbpgContext, v1 string, v2 string, v3 string) string {
+	return v2
+}
+
+// Label = "@" Literal
+func (p *pbpgParser) stateLabel() (string, error) {
+	var err error
+	entryPos := p.pos
+	var ret string
+	var v1 string
+	var v2 string
+	p.productions = append(p.productions, "Label")
+	v1, err = p.literal("@")
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"@\"")
+	}
+	if err == nil {
+		v2ErrorStack := p.errorStack
+		p.errorStack = p.errorStack.fresh()
+		v2, err = p.stateLiteral()
+		if p.errorStack.coalesce() != nil {
+			v2ErrorStack.merge(p.errorStack)
+		}
+		p.errorStack = v2ErrorStack
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Label")
+		ret = p.Data.actionLabel(p.pos, ctx, v1, v2)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionLabel(pos int, ctx pbpgContext, v1 string, v2 string) string {
+	return v2
+}
+
+// Binding = Name ":"
+func (p *pbpgParser) stateBinding() (string, error) {
+	var err error
+	entryPos := p.pos
+	var ret string
+	var v1 string
+	var v2 string
+	p.productions = append(p.productions, "Binding")
+	v1ErrorStack := p.errorStack
+	p.errorStack = p.errorStack.fresh()
+	v1, err = p.stateName()
+	if p.errorStack.coalesce() != nil {
+		v1ErrorStack.merge(p.errorStack)
+	}
+	p.errorStack = v1ErrorStack
+	if err == nil {
+		v2, err = p.literal(":")
+		if err != nil {
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "\":\"")
+		}
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Binding")
+		ret = p.Data.actionBinding(p.pos, ctx, v1, v2)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionBinding(pos int, ctx pbpgContext, v1 string, v2 string) string {
+	return v1
+}
+
+// Parameters = parameters
+func (p *pbpgParser) stateParameters() ([]string, error) {
+	var err error
+	entryPos := p.pos
+	var ret []string
+	var v1 string
+	p.productions = append(p.productions, "Parameters")
+	{
+		n, lexeme, lerr := p.Data.lexparameters(p.input[p.pos:])
+		if lerr != nil {
+			err = lerr
+		} else {
+			err = nil
+			p.pos += n
+			v1 = lexeme
+		}
+	}
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "parameters")
+	}
+	if err == nil {
+		ctx := p.context(entryPos, "Parameters")
+		ret = p.Data.actionParameters(p.pos, ctx, v1)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
+	return ret, err
+}
+
+func (p *pbpgData) actionParameters(pos int, ctx pbpgContext, v1 string) []string {
+	return splitList(v1)
+}
+
+// Arguments = arguments
+func (p *pbpgParser) stateArguments() ([]string, error) {
+	var err error
+	entryPos := p.pos
+	var ret []string
+	var v1 string
+	p.productions = append(p.productions, "Arguments")
+	{
+		n, lexeme, lerr := p.Data.lexarguments(p.input[p.pos:])
+		if lerr != nil {
+			err = lerr
+		} else {
+			err = nil
+			p.pos += n
+			v1 = lexeme
+		}
+	}
+	if err != nil {
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "arguments")
 	}
 	if err == nil {
-		v2ErrorStack := p.errorStack
-		p.errorStack = &parserErrorStack{}
-		v2, err = p.stateQuotedString()
-		if p.errorStack.coalesce() != nil {
-			v2ErrorStack.merge(p.errorStack)
-		}
-		p.errorStack = v2ErrorStack
-		if err == nil {
-			v3, err = p.literal("\"")
-			if err != nil {
-				p.errorStack.error(err, p.pos)
-			}
-		}
+		ctx := p.context(entryPos, "Arguments")
+		ret = p.Data.actionArguments(p.pos, ctx, v1)
 	}
-	if err == nil {
-		ret = p.Data.actionLiteral(p.pos, v1, v2, v3)
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionLiteral(pos int, v1 string, v2 string, v3 string) string {
-	return v2
+func (p *pbpgData) actionArguments(pos int, ctx pbpgContext, v1 string) []string {
+	return splitList(v1)
 }
 
 // Name = name
 func (p *pbpgParser) stateName() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
+	p.productions = append(p.productions, "Name")
 	{
 		n, lexeme, lerr := p.Data.lexname(p.input[p.pos:])
-		p.pos += n
 		if lerr != nil {
 			err = lerr
 		} else {
 			err = nil
+			p.pos += n
 			v1 = lexeme
 		}
 	}
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "name")
 	}
 	if err == nil {
-		ret = p.Data.actionName(p.pos, v1)
+		ctx := p.context(entryPos, "Name")
+		ret = p.Data.actionName(p.pos, ctx, v1)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionName(pos int, v1 string) string {
+func (p *pbpgData) actionName(pos int, ctx pbpgContext, v1 string) string {
 	return v1
 }
 
@@ -833,108 +1749,134 @@ func (p *pbpgData) actionName(pos int, v1 string) string {
 // Code = code
 func (p *pbpgParser) stateCode() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
+	p.productions = append(p.productions, "Code")
 	{
 		n, lexeme, lerr := p.Data.lexcode(p.input[p.pos:])
-		p.pos += n
 		if lerr != nil {
 			err = lerr
 		} else {
 			err = nil
+			p.pos += n
 			v1 = lexeme
 		}
 	}
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "code")
 	}
 	if err == nil {
-		ret = p.Data.actionCode(p.pos, v1)
+		ctx := p.context(entryPos, "Code")
+		ret = p.Data.actionCode(p.pos, ctx, v1)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionCode(pos int, v1 string) string {
+func (p *pbpgData) actionCode(pos int, ctx pbpgContext, v1 string) string {
 	return v1
 }
 
 // QuotedString = quotedstring
 func (p *pbpgParser) stateQuotedString() (string, error) {
 	var err error
+	entryPos := p.pos
 	var ret string
 	var v1 string
+	p.productions = append(p.productions, "QuotedString")
 	{
 		n, lexeme, lerr := p.Data.lexquotedstring(p.input[p.pos:])
-		p.pos += n
 		if lerr != nil {
 			err = lerr
 		} else {
 			err = nil
+			p.pos += n
 			v1 = lexeme
 		}
 	}
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "quotedstring")
 	}
 	if err == nil {
-		ret = p.Data.actionQuotedString(p.pos, v1)
+		ctx := p.context(entryPos, "QuotedString")
+		ret = p.Data.actionQuotedString(p.pos, ctx, v1)
+	}
+
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
 	}
 
+	p.productions = p.productions[:len(p.productions)-1]
 	return ret, err
 }
 
-func (p *pbpgData) actionQuotedString(pos int, v1 string) string {
+func (p *pbpgData) actionQuotedString(pos int, ctx pbpgContext, v1 string) string {
 	return v1
 }
 
 // Comment = "#" comment
 func (p *pbpgParser) stateComment() error {
 	var err error
+	entryPos := p.pos
 	var v1 string
 	var v2 string
+	p.productions = append(p.productions, "Comment")
 	v1, err = p.literal("#")
 	if err != nil {
-		p.errorStack.error(err, p.pos)
+		p.errorStack.expect(err, p.errorPos(err), p.productions, "\"#\"")
 	}
 	if err == nil {
 		{
 			n, lexeme, lerr := p.Data.lexcomment(p.input[p.pos:])
-			p.pos += n
 			if lerr != nil {
 				err = lerr
 			} else {
 				err = nil
+				p.pos += n
 				v2 = lexeme
 			}
 		}
 		if err != nil {
-			p.errorStack.error(err, p.pos)
+			p.errorStack.expect(err, p.errorPos(err), p.productions, "comment")
 		}
 	}
 	if err == nil {
-		p.Data.actionComment(p.pos, v1, v2)
+		ctx := p.context(entryPos, "Comment")
+		pos := p.pos
+		p.queue(func() { p.Data.actionComment(pos, ctx, v1, v2) })
 	}
 
+	if err != nil {
+		p.errorStack.label(p.skipSpace(entryPos), p.productions)
+	}
+
+	p.productions = p.productions[:len(p.productions)-1]
 	return err
 }
 
-func (p *pbpgData) actionComment(pos int, v1 string, v2 string) {
-	p.out.WriteString("// " + v2 + "\n")
+func (p *pbpgData) actionComment(pos int, ctx pbpgContext, v1 string, v2 string) {
+	p.lines = append(p.lines, line{comment: v2})
 }
 
-func Parsepbpg(input string, data *pbpgData) error {
+func Parsepbpg(input string, data *pbpgData) (err error) {
 	p := newpbpgParser(input, data)
+	defer p.diagnose(&err)
 
-	err := p.stateProgram()
+	err = p.stateProgram()
 	if err == nil {
 		if strings.TrimSpace(p.input[p.pos:]) != "" {
-			err = p.errorStack.coalesce()
-			return err
+			err = p.trailingError()
 		}
 	} else {
-		err = p.errorStack.coalesce()
+		err = p.parseError()
 	}
+	err = p.recoveredErrors(err)
 
 	return err
 }
@@ -945,17 +1887,30 @@ type pbpgParser struct {
 	lineOffsets []int
 	Data        *pbpgData
 	errorStack  *parserErrorStack
+	productions []string                       // the productions currently being parsed, outermost first
+	recovered   []error                        // errors set aside by Recover blocks
+	deferred    []func()                       // actions waiting for the current prediction to be accepted, with -defer
+	undo        []func()                       // functions given to Undo by actions in the current prediction
+	memo        map[pbpgmemoKey]*pbpgmemoEntry // remembered results of productions, by position
 
 	predictStack []*pbpgParser
 }
 
 func newpbpgParser(input string, data *pbpgData) *pbpgParser {
-	return &pbpgParser{
+	p := &pbpgParser{
 		input:       input,
 		lineOffsets: pbpgGenerateLineOffsets(input),
 		Data:        data,
 		errorStack:  &parserErrorStack{},
+		memo:        make(map[pbpgmemoKey]*pbpgmemoEntry),
 	}
+	if _, ok := interface{}(data).(pbpgErrorPolicy); ok {
+		p.errorStack.chains = true
+	}
+	if d := p.diagnostics(); d != nil {
+		d.warnings = nil
+	}
+	return p
 }
 
 func pbpgGenerateLineOffsets(input string) []int {
@@ -971,20 +1926,201 @@ func pbpgGenerateLineOffsets(input string) []int {
 	return ret
 }
 
+// position returns the 1-based line and column of the byte offset pos.
+func (p *pbpgParser) position(pos int) (int, int) {
+	return pbpgContext{input: p.input, lineOffsets: p.lineOffsets}.position(pos)
+}
+
+// pbpgContext describes the input matched by a production, and is given
+// to the production's action.
+type pbpgContext struct {
+	Start      int    // byte offset of the match, after any leading whitespace
+	End        int    // byte offset just past the match
+	Production string // name of the matched production
+
+	input       string
+	lineOffsets []int
+	parser      *pbpgParser
+}
+
+// context returns the context of production, which was entered at pos and
+// matched up to the current position.
+func (p *pbpgParser) context(pos int, production string) pbpgContext {
+	start := p.skipSpace(pos)
+	if start > p.pos {
+		start = p.pos
+	}
+	return pbpgContext{
+		Start:       start,
+		End:         p.pos,
+		Production:  production,
+		input:       p.input,
+		lineOffsets: p.lineOffsets,
+		parser:      p,
+	}
+}
+
+// Text returns the matched input.
+func (c pbpgContext) Text() string {
+	return c.input[c.Start:c.End]
+}
+
+// Undo registers f to be called if the parser backtracks over the matched
+// input, so that an action can reverse its side effects on the data object.
+// Functions are called most recent first. Undo has no effect once the input
+// can no longer be backtracked, including in actions deferred with -defer.
+func (c pbpgContext) Undo(f func()) {
+	if c.parser != nil {
+		c.parser.onUndo(f)
+	}
+}
+
+// Line returns the 1-based line the match starts on.
+func (c pbpgContext) Line() int {
+	line, _ := c.position(c.Start)
+	return line
+}
+
+// Column returns the 1-based column, in runes, the match starts at.
+func (c pbpgContext) Column() int {
+	_, column := c.position(c.Start)
+	return column
+}
+
+func (c pbpgContext) position(pos int) (int, int) {
+	lo, hi := 0, len(c.lineOffsets)-1
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if c.lineOffsets[mid] <= pos {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+
+	start := 0
+	if lo > 0 {
+		start = c.lineOffsets[lo-1]
+	}
+	return lo + 1, utf8.RuneCountInString(c.input[start:pos]) + 1
+}
+
+// Pretty returns the error message followed by the line of input containing
+// the error, with a caret under the failing column.
+func (e *pbpgParseError) Pretty(input string) string {
+	offsets := pbpgGenerateLineOffsets(input)
+	if e.Line < 1 || e.Line > len(offsets) {
+		return e.Error()
+	}
+
+	start := 0
+	if e.Line > 1 {
+		start = offsets[e.Line-2]
+	}
+	end := offsets[e.Line-1] - 1
+	if end > len(input) {
+		end = len(input)
+	}
+	line := strings.TrimSuffix(input[start:end], "\r")
+
+	// keep tabs in the padding so the caret lines up with the input
+	var pad strings.Builder
+	column := 1
+	for _, r := range line {
+		if column >= e.Column {
+			break
+		}
+		if r == '\t' {
+			pad.WriteRune('\t')
+		} else {
+			pad.WriteRune(' ')
+		}
+		column++
+	}
+
+	return e.Error() + "\n" + line + "\n" + pad.String() + "^"
+}
+
+// sync skips the input past the first of the sync literals found after the
+// farthest error on the error stack. Quoted strings and blocks in braces, such
+// as code, are skipped whole, so a sync literal inside of them is not matched.
+// It returns false, leaving the position unchanged, if none of the sync
+// literals are found.
+func (p *pbpgParser) sync(sync ...string) bool {
+	pos := p.errorStack.depth()
+	if pos < p.pos {
+		pos = p.pos
+	}
+
+	var depth int
+	for i := pos; i < len(p.input); i++ {
+		if depth == 0 {
+			for _, v := range sync {
+				if v != "" && strings.HasPrefix(p.input[i:], v) {
+					p.pos = i + len(v)
+					return true
+				}
+			}
+		}
+		switch p.input[i] {
+		case '{':
+			depth++
+		case '}':
+			if depth > 0 {
+				depth--
+			}
+		case '"', '\x60':
+			i = p.skipQuoted(i)
+		case '\'':
+			// outside of braces, a single quote is more likely an
+			// apostrophe than the start of a character literal.
+			if depth > 0 {
+				i = p.skipQuoted(i)
+			}
+		}
+	}
+	return false
+}
+
+// skipQuoted returns the position of the quote closing the string that starts
+// at pos. Strings in double or single quotes can contain escaped quotes, and
+// end at the end of the line if they are not closed. Strings in back quotes
+// end at the end of the input.
+func (p *pbpgParser) skipQuoted(pos int) int {
+	q := p.input[pos]
+	for i := pos + 1; i < len(p.input); i++ {
+		switch c := p.input[i]; {
+		case c == q:
+			return i
+		case c == '\\' && q != '\x60':
+			i++
+		case c == '\n' && q != '\x60':
+			return i
+		}
+	}
+	return len(p.input)
+}
+
+// skipSpace returns the position of the first non-whitespace character at or
+// after pos.
+func (p *pbpgParser) skipSpace(pos int) int {
+	for r, s := utf8.DecodeRuneInString(p.input[pos:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[pos:]) {
+		pos += s
+	}
+	return pos
+}
+
 func (p *pbpgParser) literal(want string) (string, error) {
 	var errExpected = fmt.Errorf("expected %v", want)
 
-	count := 0
-	for r, s := utf8.DecodeRuneInString(p.input[p.pos+count:]); s > 0 && unicode.IsSpace(r); r, s = utf8.DecodeRuneInString(p.input[p.pos+count:]) {
-		count += s
-	}
+	count := p.skipSpace(p.pos) - p.pos
 
 	if strings.HasPrefix(p.input[p.pos+count:], want) {
 		p.pos += count + len(want)
 		return want, nil
 	}
 
-	return "", errExpected
+	return "", &pbpgLexError{Offset: count, Err: errExpected}
 }
 
 func (p *pbpgParser) predict() *pbpgParser {
@@ -995,84 +2131,606 @@ func (p *pbpgParser) predict() *pbpgParser {
 		lineOffsets:  p.lineOffsets,
 		predictStack: p.predictStack,
 		errorStack:   p.errorStack,
+		productions:  p.productions,
+		recovered:    p.recovered,
+		deferred:     p.deferred,
+		undo:         p.undo,
+		memo:         p.memo,
 		Data:         p.Data,
 	}
 }
 
+// backtrack abandons the current prediction, calling the functions given to
+// Undo since it began, most recent first.
 func (p *pbpgParser) backtrack() *pbpgParser {
+	pp := p.pop()
+	for i := len(p.undo) - 1; i >= len(pp.undo); i-- {
+		p.undo[i]()
+	}
+	return pp
+}
+
+// pop returns the parser the current prediction began from, with the errors
+// recorded since.
+func (p *pbpgParser) pop() *pbpgParser {
 	pp := p.predictStack[len(p.predictStack)-1]
 	pp.predictStack = pp.predictStack[:len(pp.predictStack)-1]
 	pp.errorStack = p.errorStack
 	return pp
 }
 
+// keep returns the parser the current prediction began from, like backtrack,
+// but without undoing the actions run since, whose results are kept.
+func (p *pbpgParser) keep() *pbpgParser {
+	pp := p.pop()
+	if len(pp.predictStack) > 0 {
+		pp.undo = p.undo
+	}
+	return pp
+}
+
 func (p *pbpgParser) accept() *pbpgParser {
-	pp := p.backtrack()
+	pp := p.pop()
 	pp.pos = p.pos
+	pp.recovered = p.recovered
+	pp.deferred = p.deferred
+	pp.undo = p.undo
+	if len(pp.predictStack) == 0 {
+		pp.undo = nil
+		pp.runDeferred()
+	}
 	return pp
 }
 
+// onUndo holds f until the outermost prediction is accepted, calling it if
+// the prediction is backtracked instead. Outside of a prediction, the input
+// can't be backtracked, so f is dropped.
+func (p *pbpgParser) onUndo(f func()) {
+	if len(p.predictStack) > 0 {
+		p.undo = append(p.undo, f)
+	}
+}
+
+// queue runs f now if the parser is not inside of a prediction, and otherwise
+// holds it until the outermost prediction is accepted. If the prediction is
+// backtracked instead, f is discarded.
+func (p *pbpgParser) queue(f func()) {
+	if len(p.predictStack) == 0 {
+		f()
+		return
+	}
+	p.deferred = append(p.deferred, f)
+}
+
+func (p *pbpgParser) runDeferred() {
+	deferred := p.deferred
+	p.deferred = nil
+	for _, f := range deferred {
+		f()
+	}
+}
+
 type parserErrorStack struct {
-	stack []*parseError
+	stack  []*parseError
+	max    int  // the greatest position on the stack
+	chains bool // keep the chain of productions of every error, for an error policy
 }
 
 type parseError struct {
-	err error
+	err         error
+	pos         int
+	productions []string // the productions being parsed when the error was recorded, outermost first
+	expected    string   // the literal, lexer, or production that was expected, if any
+}
+
+// pbpgParseError is the error returned by Parsepbpg. Offset is the
+// position of the farthest failure in the input, which is a byte offset, or a
+// token index in token mode. Line and Column are the 1-based position of
+// Offset. In token mode, Line is always 1 and Column is the token number.
+// Production is the production the failure was recorded in, and Productions
+// is the chain of productions that led to it, outermost first. Messages are
+// the distinct errors recorded at Offset. Expected is the set of quoted
+// literals, lexer function names, and production names that would have allowed
+// the parse to continue at Offset.
+type pbpgParseError struct {
+	Offset      int
+	Line        int
+	Column      int
+	Production  string
+	Productions []string
+	Messages    []string
+	Expected    []string
+
+	other []string // messages that are not expectations, with their positions
+	cause error    // the error given to Fail, if any
+}
+
+// Unwrap returns the error given to pbpgDiagnostics.Fail, if the parse was
+// aborted with Fail.
+func (e *pbpgParseError) Unwrap() error {
+	return e.cause
+}
+
+// pbpgLexError can be returned by lexer functions to report where in their
+// input they failed. Offset is relative to the input given to the lexer
+// function, and is used as the position of the error. Lexer functions that
+// return any other error fail at the start of their input.
+type pbpgLexError struct {
+	Offset int
+	Err    error
+}
+
+func (e *pbpgLexError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *pbpgLexError) Unwrap() error {
+	return e.Err
+}
+
+// pbpgDiagnostics can be embedded in pbpgData to let actions and lexer
+// functions report warnings, and abort the parse with an error, instead of
+// logging or exiting.
+type pbpgDiagnostics struct {
+	warnings []pbpgWarning
+}
+
+// pbpgWarning is a warning reported with pbpgDiagnostics.Warn. Line
+// and Column are set when Parsepbpg returns.
+type pbpgWarning struct {
+	Offset  int
+	Line    int
+	Column  int
+	Message string
+}
+
+func (w pbpgWarning) String() string {
+	return fmt.Sprintf("%v at %v:%v", w.Message, w.Line, w.Column)
+}
+
+// pbpgfailure is the panic value used by Fail to unwind the parser.
+type pbpgfailure struct {
 	pos int
+	err error
+}
+
+// Warn records a warning at the given input position. Warnings do not affect
+// the parse, and are returned by Warnings.
+func (d *pbpgDiagnostics) Warn(pos int, msg string) {
+	d.warnings = append(d.warnings, pbpgWarning{Offset: pos, Message: msg})
+}
+
+// Fail aborts the parse. Parsepbpg returns err as a *pbpgParseError at
+// the given input position. Fail does not return.
+func (d *pbpgDiagnostics) Fail(pos int, err error) {
+	panic(&pbpgfailure{pos: pos, err: err})
+}
+
+// Warnings returns the warnings reported during the most recent parse.
+func (d *pbpgDiagnostics) Warnings() []pbpgWarning {
+	return d.warnings
+}
+
+func (d *pbpgDiagnostics) diagnostics() *pbpgDiagnostics {
+	return d
+}
+
+// diagnostics returns the pbpgDiagnostics embedded in the parser's data,
+// if any.
+func (p *pbpgParser) diagnostics() *pbpgDiagnostics {
+	if p.Data == nil {
+		return nil
+	}
+	if d, ok := interface{}(p.Data).(interface{ diagnostics() *pbpgDiagnostics }); ok {
+		return d.diagnostics()
+	}
+	return nil
+}
+
+// diagnose is deferred by Parsepbpg. It turns a call to Fail into the
+// error returned by Parsepbpg, and sets the positions of any warnings.
+func (p *pbpgParser) diagnose(err *error) {
+	if r := recover(); r != nil {
+		f, ok := r.(*pbpgfailure)
+		if !ok {
+			panic(r)
+		}
+		pos := p.clamp(f.pos)
+		line, column := p.position(pos)
+		*err = p.recoveredErrors(&pbpgParseError{
+			Offset:   pos,
+			Line:     line,
+			Column:   column,
+			Messages: []string{f.err.Error()},
+			other:    []string{fmt.Sprintf("%v at %v:%v", f.err, line, column)},
+			cause:    f.err,
+		})
+	}
+
+	if d := p.diagnostics(); d != nil {
+		for i, v := range d.warnings {
+			d.warnings[i].Offset = p.clamp(v.Offset)
+			d.warnings[i].Line, d.warnings[i].Column = p.position(d.warnings[i].Offset)
+		}
+	}
+}
+
+// clamp limits pos to the input. Positions given by actions and lexer
+// functions can be anywhere, but errors and warnings are reported within the
+// input, or just past its end.
+func (p *pbpgParser) clamp(pos int) int {
+	if pos < 0 {
+		return 0
+	}
+	if pos > len(p.input) {
+		return len(p.input)
+	}
+	return pos
+}
+
+// pbpgParseErrors is returned by Parsepbpg when the parser recovered
+// from errors using Recover blocks. It holds every error in the order they
+// were encountered.
+type pbpgParseErrors []error
+
+func (e pbpgParseErrors) Error() string {
+	var s []string
+	for _, v := range e {
+		s = append(s, v.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Unwrap returns the first error, so that errors.As can be used to retrieve
+// it as a *pbpgParseError.
+func (e pbpgParseErrors) Unwrap() error {
+	return e[0]
+}
+
+func (e *pbpgParseError) Error() string {
+	var lines []string
+	if len(e.Expected) == 1 {
+		lines = append(lines, "expected "+e.Expected[0])
+	} else if len(e.Expected) > 1 {
+		lines = append(lines, "expected one of "+strings.Join(e.Expected, ", "))
+	}
+	for i := range lines {
+		lines[i] = fmt.Sprintf("%v at %v:%v", lines[i], e.Line, e.Column)
+	}
+	lines = append(lines, e.other...)
+	return strings.Join(lines, "\n")
+}
+
+// fresh returns an empty error stack for a production to record its errors
+// in.
+func (e *parserErrorStack) fresh() *parserErrorStack {
+	return &parserErrorStack{chains: e.chains}
 }
 
 func (e *parserErrorStack) clear() {
 	e.stack = []*parseError{}
+	e.max = 0
 }
 
 func (e *parserErrorStack) merge(e2 *parserErrorStack) {
 	e.stack = append(e.stack, e2.stack...)
+	if e2.max > e.max {
+		e.max = e2.max
+	}
 }
 
-func (e *parserErrorStack) error(err error, pos int) {
-	e.stack = append(e.stack, &parseError{err: err, pos: pos})
+// truncate replaces the stack with stack, which holds some of its errors.
+func (e *parserErrorStack) truncate(stack []*parseError) {
+	e.stack = stack
+	e.max = 0
+	for _, v := range stack {
+		if v.pos > e.max {
+			e.max = v.pos
+		}
+	}
 }
 
-func (e *parserErrorStack) coalesce() error {
+// push adds v to the stack, recorded in productions. Only the errors at least
+// as far as every error before them can be reported, so the chain of
+// productions, which changes as the parse goes on, is only copied for those,
+// unless an error policy is given every error.
+func (e *parserErrorStack) push(v *parseError, productions []string) {
+	if e.chains || v.pos >= e.max {
+		v.productions = append([]string(nil), productions...)
+	}
+	if v.pos > e.max {
+		e.max = v.pos
+	}
+	e.stack = append(e.stack, v)
+}
+
+func (e *parserErrorStack) error(err error, pos int, productions []string) {
+	e.push(&parseError{err: err, pos: pos}, productions)
+}
+
+// reject records err for an action that rejected the input matched since
+// mark. The errors recorded since mark were ones the parser got past, so they
+// are dropped, leaving only the action's error at pos.
+func (e *parserErrorStack) reject(err error, mark int, pos int, productions []string) {
+	if mark < len(e.stack) {
+		e.truncate(e.stack[:mark])
+	}
+	e.error(err, pos, productions)
+}
+
+// expect records err as a failure to match the given literal, lexer, or
+// production.
+func (e *parserErrorStack) expect(err error, pos int, productions []string, expected string) {
+	e.push(&parseError{err: err, pos: pos, expected: expected}, productions)
+}
+
+// label replaces the expectations on the stack with a single expectation of
+// the innermost production in productions, as long as nothing was recorded
+// past pos. This is used when a production fails without consuming any input,
+// so that the error names the production instead of everything inside of it.
+// The new expectation is recorded against the production's caller.
+func (e *parserErrorStack) label(pos int, productions []string) {
+	if len(productions) == 0 {
+		return
+	}
+	e.relabel(0, pos, productions[:len(productions)-1], productions[len(productions)-1])
+}
+
+// relabel replaces the expectations recorded since mark with a single
+// expectation of label, as long as none of them are past pos.
+func (e *parserErrorStack) relabel(mark int, pos int, productions []string, label string) {
+	for _, v := range e.stack[mark:] {
+		if v.pos > pos {
+			return
+		}
+	}
+
+	stack := e.stack[:mark]
+	for _, v := range e.stack[mark:] {
+		if v.expected == "" {
+			stack = append(stack, v)
+		}
+	}
+	e.truncate(stack)
+	e.push(&parseError{
+		err:      fmt.Errorf("expected %v", label),
+		pos:      pos,
+		expected: label,
+	}, productions)
+}
+
+// farthest returns the errors recorded at the greatest depth, deduplicated and
+// in the order they were recorded.
+func (e *parserErrorStack) farthest() []*parseError {
+	return farthestErrors(e.stack)
+}
+
+// farthestErrors returns the errors in stack recorded at the greatest depth,
+// deduplicated and in the order they were recorded.
+func farthestErrors(stack []*parseError) []*parseError {
 	var bestDepth int
-	var es []error
+	var es []*parseError
 
 COALESCE_OUTER:
-	for _, v := range e.stack {
+	for _, v := range stack {
 		if v.pos > bestDepth {
 			bestDepth = v.pos
-			es = []error{v.err}
+			es = []*parseError{v}
 		} else if v.pos == bestDepth {
 			// deduplicate errors at a given depth
 			for _, w := range es {
-				if w.Error() == v.err.Error() {
+				if w.expected == v.expected && w.err.Error() == v.err.Error() {
 					continue COALESCE_OUTER
 				}
 			}
-			es = append(es, v.err)
+			es = append(es, v)
 		}
 	}
+	return es
+}
+
+func (e *parserErrorStack) coalesce() error {
+	es := e.farthest()
 
 	if len(es) == 0 {
 		return nil
 	} else if len(es) == 1 {
-		return es[0]
+		return es[0].err
 	} else {
 		// print the error stack in reverse order
 		var ret string
 		for i := len(es) - 1; i >= 0; i-- {
-			ret += es[i].Error() + "\n"
+			ret += es[i].err.Error() + "\n"
 		}
 		return errors.New(strings.TrimSpace(ret))
 	}
 }
 
 func (e *parserErrorStack) depth() int {
-	var ret int
-	for _, v := range e.stack {
-		if v.pos > ret {
-			ret = v.pos
+	return e.max
+}
+
+// pbpgErrorRecord is an error recorded while parsing. Offset is its
+// position in the input, Productions is the chain of productions it was
+// recorded in, outermost first, and Expected is the literal, lexer function,
+// or production that was expected there, if any.
+type pbpgErrorRecord struct {
+	Err         error
+	Offset      int
+	Productions []string
+	Expected    string
+}
+
+// pbpgErrorPolicy can be implemented by pbpgData to choose which of
+// the recorded errors are reported. ErrorPolicy is given every error recorded
+// while parsing the failed production, in the order they were recorded, and
+// returns the errors to report. The first error returned sets the position of
+// the pbpgParseError. If it returns no errors, the default policy
+// (pbpgFarthestErrors) is used.
+type pbpgErrorPolicy interface {
+	ErrorPolicy(stack []*pbpgErrorRecord) []*pbpgErrorRecord
+}
+
+// pbpgFarthestErrors is the default error policy. It returns the errors
+// in stack recorded at the greatest offset, deduplicated and in the order they
+// were recorded.
+func pbpgFarthestErrors(stack []*pbpgErrorRecord) []*pbpgErrorRecord {
+	var es []*parseError
+	for _, v := range stack {
+		es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
+	}
+	return pbpgerrorRecords(farthestErrors(es))
+}
+
+// pbpgerrorRecords returns the records of the errors in stack.
+func pbpgerrorRecords(stack []*parseError) []*pbpgErrorRecord {
+	var r []*pbpgErrorRecord
+	for _, v := range stack {
+		r = append(r, &pbpgErrorRecord{Err: v.err, Offset: v.pos, Productions: v.productions, Expected: v.expected})
+	}
+	return r
+}
+
+// parseError returns the errors chosen by the error policy from the parser's
+// error stack as a pbpgParseError, or nil if there are none.
+func (p *pbpgParser) parseError() error {
+	var es []*parseError
+	if policy, ok := interface{}(p.Data).(pbpgErrorPolicy); ok {
+		for _, v := range policy.ErrorPolicy(pbpgerrorRecords(p.errorStack.stack)) {
+			es = append(es, &parseError{err: v.Err, pos: v.Offset, productions: v.Productions, expected: v.Expected})
+		}
+	}
+	if len(es) == 0 {
+		es = p.errorStack.farthest()
+	}
+	if len(es) == 0 {
+		return nil
+	}
+
+	line, column := p.position(es[0].pos)
+	ret := &pbpgParseError{
+		Offset:      es[0].pos,
+		Line:        line,
+		Column:      column,
+		Productions: es[0].productions,
+	}
+	if len(ret.Productions) > 0 {
+		ret.Production = ret.Productions[len(ret.Productions)-1]
+	}
+
+EXPECTED_LOOP:
+	for _, v := range es {
+		ret.Messages = append(ret.Messages, v.err.Error())
+		if v.expected == "" {
+			// errors from Error blocks often wrap the default error,
+			// which already has a position
+			var perr *pbpgParseError
+			if errors.As(v.err, &perr) {
+				ret.other = append(ret.other, v.err.Error())
+			} else {
+				ret.other = append(ret.other, fmt.Sprintf("%v at %v:%v", v.err, line, column))
+			}
+			continue
+		}
+		for _, w := range ret.Expected {
+			if w == v.expected {
+				continue EXPECTED_LOOP
+			}
 		}
+		ret.Expected = append(ret.Expected, v.expected)
 	}
 	return ret
 }
+
+// recover implements Recover blocks. It skips the input past the first of the
+// sync literals found after the farthest error, and sets the error aside to be
+// returned by Parsepbpg. It returns false if none of the sync literals are
+// found.
+func (p *pbpgParser) recover(sync ...string) bool {
+	if !p.sync(sync...) {
+		return false
+	}
+	if err := p.parseError(); err != nil {
+		p.recovered = append(p.recovered, err)
+	}
+	p.errorStack.clear()
+	return true
+}
+
+// recoveredErrors returns err along with any errors set aside by Recover
+// blocks. If there is more than one error, they are returned as a
+// pbpgParseErrors.
+func (p *pbpgParser) recoveredErrors(err error) error {
+	if len(p.recovered) == 0 {
+		return err
+	}
+
+	errs := p.recovered
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return pbpgParseErrors(errs)
+}
+
+// errorPos returns the position of a failed term. Literals and lexer functions
+// report failures past the current position by returning a pbpgLexError.
+func (p *pbpgParser) errorPos(err error) int {
+	var lerr *pbpgLexError
+	if errors.As(err, &lerr) {
+		return p.clamp(p.pos + lerr.Offset)
+	}
+	return p.pos
+}
+
+// trailingError returns the error for input left over after a successful
+// parse of the entrypoint.
+func (p *pbpgParser) trailingError() error {
+	pos := p.skipSpace(p.pos)
+	if len(p.errorStack.stack) == 0 || p.errorStack.depth() < pos {
+		p.errorStack.error(errors.New("unexpected input"), pos, p.productions)
+	}
+	return p.parseError()
+}
+
+// pbpgmemoKey identifies the result of a production at a position.
+type pbpgmemoKey struct {
+	id  int
+	pos int
+}
+
+// pbpgmemoEntry is a remembered result of a production: its value, the
+// position just past the input it matched, its error, and the errors,
+// deferred actions, and recovered errors it left behind.
+type pbpgmemoEntry struct {
+	value     interface{}
+	end       int
+	err       error
+	errors    *parserErrorStack
+	deferred  []func()
+	recovered []error
+}
+
+// pbpgerrLeftRecursion fails a left recursive production that calls
+// itself before it has matched anything at a position.
+var pbpgerrLeftRecursion = errors.New("left recursion")
+
+// recall moves the parser past the input matched by a remembered result,
+// records its errors again, and queues its deferred actions again, returning
+// its error.
+func (p *pbpgParser) recall(m *pbpgmemoEntry) error {
+	if m.errors != nil {
+		p.errorStack.merge(m.errors)
+	}
+	p.pos = m.end
+	if m.err != nil {
+		return m.err
+	}
+	p.recovered = append(p.recovered, m.recovered...)
+	for _, f := range m.deferred {
+		p.queue(f)
+	}
+	return nil
+}
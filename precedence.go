@@ -0,0 +1,144 @@
+/*************************************************************************
+ * Copyright 2022 Gravwell, Inc. All rights reserved.
+ * Contact: <legal@gravwell.io>
+ *
+ * This software may be modified and distributed under the terms of the
+ * BSD 2-clause license. See the LICENSE file for details.
+ **************************************************************************/
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A precedenceLevel is one line of a precedence table, such as %left "+" "-".
+// Levels declared later bind more tightly.
+type precedenceLevel struct {
+	right     bool
+	operators []string
+}
+
+func (l *precedenceLevel) String() string {
+	r := "%left"
+	if l.right {
+		r = "%right"
+	}
+	for _, v := range l.operators {
+		r += " " + strconv.Quote(v)
+	}
+	return r
+}
+
+// checkPrecedence returns an error if a production with a precedence table
+// is not made of a single operand with the type of the production, or if it
+// has no action to combine its operands with.
+func (p *pbpgData) checkPrecedence(prod *Production) error {
+	if prod.params != nil || prod.inherited != nil {
+		return errors.New("a production with a precedence table cannot have parameters")
+	}
+	exp := prod.exp
+	if exp == nil || len(exp.alternatives) != 1 || len(exp.alternatives[0].terms) != 1 {
+		return errors.New("a production with a precedence table must be a single operand")
+	}
+	t := exp.alternatives[0].terms[0]
+	if t.option != TERM_NAME || t.args != nil || t.binding != "" {
+		return errors.New("the operand of a precedence table must be a production name")
+	}
+	if exp.alternatives[0].action != nil || prod.action == nil {
+		return errors.New("a production with a precedence table must have an action for its operators")
+	}
+	ftype, ok := p.typeMap[prod.name]
+	if !ok {
+		return errors.New("a production with a precedence table must have a type")
+	}
+	if otype, ok := p.typeMap[t.name]; !ok || strings.TrimSpace(otype) != strings.TrimSpace(ftype) {
+		return fmt.Errorf("the operand %v must have the same type as the production", t.name)
+	}
+
+	seen := make(map[string]bool)
+	for _, level := range prod.precedence {
+		for _, op := range level.operators {
+			if op == "" {
+				return errors.New("empty operator in precedence table")
+			}
+			if seen[op] {
+				return fmt.Errorf("operator %q declared more than once", op)
+			}
+			seen[op] = true
+		}
+	}
+	return nil
+}
+
+// emitClimb emits the precedence climbing function of a production with a
+// precedence table. climb<name>(min) parses an operand, followed by any
+// operators binding at least as tightly as min and their right hand sides,
+// combining each pair with the action of the production. Operators are
+// matched longest first, so that "<=" is not read as "<".
+func (p *pbpgData) emitClimb(prod *Production) {
+	name, a := prod.name, prod.action
+	ftype := p.typeMap[name]
+	operand := prod.exp.alternatives[0].terms[0].name
+
+	type operator struct {
+		op    string
+		prec  int
+		right bool
+	}
+	var ops []operator
+	for i, level := range prod.precedence {
+		for _, op := range level.operators {
+			ops = append(ops, operator{op, i + 1, level.right})
+		}
+	}
+	sort.SliceStable(ops, func(i, j int) bool {
+		return len(ops[i].op) > len(ops[j].op)
+	})
+
+	p.out.WriteString(fmt.Sprintf("func (p *%vParser) climb%v(min int) (%v, error) {\n", *fPrefix, name, ftype))
+	p.out.WriteString("entryPos := p.pos\n")
+	if a.fallible {
+		p.out.WriteString("entryMark := len(p.errorStack.stack)\n")
+	}
+	p.out.WriteString("operandErrorStack := p.errorStack; p.errorStack = p.errorStack.fresh()\n")
+	p.out.WriteString(fmt.Sprintf("lhs, err := p.state%v()\n", operand))
+	p.out.WriteString("if p.errorStack.coalesce() != nil { operandErrorStack.merge(p.errorStack) }; p.errorStack = operandErrorStack\n")
+	p.out.WriteString("if err != nil { return lhs, err }\n\n")
+
+	p.out.WriteString("for {\n")
+	// an operator that doesn't bind tightly enough, or isn't followed by
+	// an operand, is left for the caller.
+	p.out.WriteString("p = p.predict()\n")
+	p.out.WriteString("var op string\nvar level, next int\n")
+	for i, v := range ops {
+		next := v.prec + 1
+		if v.right {
+			next = v.prec
+		}
+		if i > 0 {
+			p.out.WriteString("if op == \"\" {\n")
+		}
+		p.out.WriteString(fmt.Sprintf("if _, err = p.literal(%v); err == nil { op, level, next = %v, %v, %v } else { p.errorStack.expect(err, p.errorPos(err), p.productions, %v) }\n", strconv.Quote(v.op), strconv.Quote(v.op), v.prec, next, strconv.Quote(strconv.Quote(v.op))))
+		if i > 0 {
+			p.out.WriteString("}\n")
+		}
+	}
+	p.out.WriteString("if op == \"\" || level < min { p = p.backtrack(); break }\n")
+	p.out.WriteString(fmt.Sprintf("var rhs %v\n", ftype))
+	p.out.WriteString(fmt.Sprintf("rhs, err = p.climb%v(next)\n", name))
+	p.out.WriteString("if err != nil { p = p.backtrack(); break }\n")
+	p.out.WriteString(fmt.Sprintf("ctx := p.context(entryPos, %v)\n", strconv.Quote(name)))
+	if a.fallible {
+		p.out.WriteString(fmt.Sprintf("lhs, err = p.Data.action%v(p.pos, ctx, lhs, op, rhs)\n", name))
+		p.out.WriteString("if err != nil { p.errorStack.reject(err, entryMark, p.pos, p.productions); p = p.backtrack(); return lhs, err }\n")
+	} else {
+		p.out.WriteString(fmt.Sprintf("lhs = p.Data.action%v(p.pos, ctx, lhs, op, rhs)\n", name))
+	}
+	p.out.WriteString("p = p.accept()\n")
+	p.out.WriteString("}\n")
+	p.out.WriteString("return lhs, nil\n}\n\n")
+}
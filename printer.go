@@ -16,9 +16,29 @@ import (
 func (d *pbpgData) PrintGrammar() string {
 	var s strings.Builder
 	w := tabwriter.NewWriter(&s, 0, 0, 1, ' ', 0)
-	for _, v := range d.orderedStates {
-		e := d.stateMap[v]
-		row := fmt.Sprintf("%v\t=\t%v\n", v, e.String())
+	for _, v := range d.lines {
+		if v.production == nil {
+			continue
+		}
+		name := v.production.name
+		if v.production.params != nil {
+			name += "(" + strings.Join(v.production.params, ", ") + ")"
+		}
+		if v.production.inherited != nil {
+			var params []string
+			for _, p := range v.production.inherited {
+				params = append(params, p.name+" "+p.typ)
+			}
+			name += "(" + strings.Join(params, ", ") + ")"
+		}
+		if v.production.memo {
+			name += " @memo"
+		}
+		exp := v.production.exp.String()
+		for _, l := range v.production.precedence {
+			exp += " " + l.String()
+		}
+		row := fmt.Sprintf("%v\t=\t%v\n", name, exp)
 		w.Write([]byte(row))
 	}
 	w.Flush()